@@ -0,0 +1,383 @@
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/dcrodman/bb_reverse_proxy/proxy"
+)
+
+// AnonymizeConfig controls how a capture is anonymized.
+type AnonymizeConfig struct {
+	// Maps the server side port of PSO connections to the name of the server
+	// running on it. Packets on any other port are dropped.
+	Ports map[uint16]string
+	// Defaults to proxy.BuildCrypts.
+	CryptBuilder proxy.CryptBuilder
+	// Used for a summary of what was changed. Defaults to stderr.
+	Logger *log.Logger
+}
+
+// A captured frame, decoded without copying so that changes to the TCP payload
+// and addresses are made in the frame's data.
+type frame struct {
+	data    []byte
+	ci      gopacket.CaptureInfo
+	network gopacket.NetworkLayer
+	tcp     *layers.TCP
+}
+
+// A TCP segment's payload and where it belongs in its stream.
+type segment struct {
+	payload []byte
+	offset  int64
+}
+
+// One direction of a connection, reassembled.
+type flowStream struct {
+	segments []segment
+	haveBase bool
+	base     uint32
+}
+
+// A connection between a client and one of the servers.
+type connection struct {
+	serverName     string
+	client, server *flowStream
+	clientIP       net.IP
+
+	// Filled in by decode.
+	clientData, serverData       []byte
+	clientPackets, serverPackets []*proxy.PacketMsg
+	welcome                      []byte
+	protocol                     proxy.Protocol
+	// How much of the client and server data was decoded into packets.
+	decodedUpTo [2]int
+}
+
+// AnonymizeFile anonymizes the pcap or pcapng file at inPath, writing a pcap
+// file to outPath.
+func AnonymizeFile(inPath, outPath string, config AnonymizeConfig) error {
+	in, err := os.Open(inPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(outPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := Anonymize(in, out, config); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Anonymize reads a pcap or pcapng capture from r and writes a pcap capture of
+// its PSO connections to w with client addresses, usernames, guild card numbers
+// and character and team names consistently replaced by pseudonyms, and
+// passwords, hardware IDs and security data masked. The data is decrypted,
+// rewritten with values of the same length and encrypted again, so every frame
+// keeps its size and sequence numbers. Connections whose welcome packet isn't
+// in the capture can't be decrypted and have their payloads zeroed, as does
+// anything after a gap in a stream. All other traffic is dropped.
+func Anonymize(r io.Reader, w io.Writer, config AnonymizeConfig) error {
+	if config.CryptBuilder == nil {
+		config.CryptBuilder = proxy.BuildCrypts
+	}
+	if config.Logger == nil {
+		config.Logger = log.New(os.Stderr, "", log.Ltime)
+	}
+	reader, err := newPacketReader(r)
+	if err != nil {
+		return err
+	}
+
+	var frames []*frame
+	var order []string
+	connections := make(map[string]*connection)
+	dropped := 0
+	for {
+		data, ci, err := reader.ReadPacketData()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read capture: %s", err.Error())
+		}
+		packet := gopacket.NewPacket(data, reader.LinkType(), gopacket.DecodeOptions{NoCopy: true, Lazy: true})
+		network := packet.NetworkLayer()
+		tcp, ok := packet.TransportLayer().(*layers.TCP)
+		if network == nil || !ok {
+			dropped++
+			continue
+		}
+		serverName, fromServer := config.Ports[uint16(tcp.SrcPort)], true
+		if serverName == "" {
+			serverName, fromServer = config.Ports[uint16(tcp.DstPort)], false
+		}
+		if serverName == "" {
+			dropped++
+			continue
+		}
+
+		f := &frame{data: data, ci: ci, network: network, tcp: tcp}
+		frames = append(frames, f)
+
+		src, dst := network.NetworkFlow().Endpoints()
+		client := net.JoinHostPort(src.String(), tcp.SrcPort.String())
+		server := net.JoinHostPort(dst.String(), tcp.DstPort.String())
+		clientIP := net.IP(src.Raw())
+		if fromServer {
+			client, server = net.JoinHostPort(dst.String(), tcp.DstPort.String()), client
+			clientIP = net.IP(dst.Raw())
+		}
+		key := client + "-" + server
+		conn := connections[key]
+		if conn == nil {
+			conn = &connection{serverName: serverName, client: &flowStream{}, server: &flowStream{},
+				clientIP: append(net.IP(nil), clientIP...)}
+			connections[key] = conn
+			order = append(order, key)
+		}
+		stream := conn.client
+		if fromServer {
+			stream = conn.server
+		}
+		stream.add(tcp)
+	}
+
+	// Decode every connection first so that identifiers learned anywhere are
+	// replaced everywhere.
+	names := newPseudonyms()
+	undecodable := 0
+	for _, key := range order {
+		conn := connections[key]
+		names.clientIP(conn.clientIP)
+		if err := conn.decode(config.CryptBuilder); err != nil {
+			config.Logger.Printf("Zeroing payloads of %s connection %s: %s\n", conn.serverName, key, err.Error())
+			undecodable++
+		}
+		for _, packet := range append(conn.clientPackets, conn.serverPackets...) {
+			names.learn(packet)
+		}
+	}
+	for _, key := range order {
+		conn := connections[key]
+		if err := conn.rewrite(config.CryptBuilder, names); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range frames {
+		rewriteAddresses(f, names)
+		fixChecksums(f)
+	}
+
+	writer := pcapgo.NewWriter(w)
+	if err := writer.WriteFileHeader(65536, reader.LinkType()); err != nil {
+		return err
+	}
+	for _, f := range frames {
+		if err := writer.WritePacket(f.ci, f.data); err != nil {
+			return err
+		}
+	}
+	config.Logger.Printf("Anonymized %d connections (%d undecodable): %d client addresses, %d usernames, "+
+		"%d guild cards and %d names replaced; %d unrelated packets dropped\n", len(order), undecodable,
+		len(names.clientIPs), len(names.usernames), len(names.guildcards), len(names.names), dropped)
+	return nil
+}
+
+func (s *flowStream) add(tcp *layers.TCP) {
+	if tcp.SYN {
+		s.base, s.haveBase = tcp.Seq+1, true
+		return
+	}
+	if !s.haveBase {
+		s.base, s.haveBase = tcp.Seq, true
+	}
+	if len(tcp.Payload) > 0 {
+		s.segments = append(s.segments, segment{payload: tcp.Payload, offset: int64(int32(tcp.Seq - s.base))})
+	}
+}
+
+// Returns the stream's data up to the first gap.
+func (s *flowStream) contiguous() []byte {
+	segments := append([]segment(nil), s.segments...)
+	sort.SliceStable(segments, func(i, j int) bool { return segments[i].offset < segments[j].offset })
+	var data []byte
+	for _, seg := range segments {
+		if seg.offset < 0 || seg.offset > int64(len(data)) {
+			if seg.offset > int64(len(data)) {
+				break
+			}
+			continue
+		}
+		if end := seg.offset + int64(len(seg.payload)); end > int64(len(data)) {
+			data = append(data, seg.payload[int64(len(data))-seg.offset:]...)
+		}
+	}
+	return data
+}
+
+// Writes data back over the stream's segments, zeroing anything past its end.
+func (s *flowStream) overwrite(data []byte) {
+	for _, seg := range s.segments {
+		for i := range seg.payload {
+			pos := seg.offset + int64(i)
+			if pos >= 0 && pos < int64(len(data)) {
+				seg.payload[i] = data[pos]
+			} else {
+				seg.payload[i] = 0
+			}
+		}
+	}
+}
+
+// Decrypts as much of both streams as possible.
+func (c *connection) decode(builder proxy.CryptBuilder) error {
+	c.clientData, c.serverData = c.client.contiguous(), c.server.contiguous()
+	welcome, protocol, err := proxy.ParseWelcome(c.serverData)
+	if err != nil {
+		return fmt.Errorf("no welcome packet: %s", err.Error())
+	}
+	clientCrypt, serverCrypt, err := builder(protocol, welcome)
+	if err != nil {
+		return err
+	}
+	c.welcome, c.protocol = welcome, protocol
+
+	var firstErr error
+	c.clientPackets, c.decodedUpTo[0], err = decodeStream(c.serverName, "Client", protocol, clientCrypt, c.clientData, 0)
+	firstErr = err
+	c.serverPackets, c.decodedUpTo[1], err = decodeStream(c.serverName, "Server", protocol, serverCrypt, c.serverData, len(welcome))
+	if firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+func decodeStream(serverName, name string, protocol proxy.Protocol, crypt proxy.Crypt, data []byte,
+	start int) ([]*proxy.PacketMsg, int, error) {
+	decoder := proxy.NewStreamDecoder(serverName, name, protocol, crypt)
+	packets, err := decoder.Write(data[start:], time.Time{})
+	end := start
+	for _, packet := range packets {
+		end += len(packet.Data)
+	}
+	return packets, end, err
+}
+
+// Replaces the connection's data with the anonymized version of its packets,
+// encrypted with the same vectors.
+func (c *connection) rewrite(builder proxy.CryptBuilder, names *pseudonyms) error {
+	clientOut := make([]byte, len(c.clientData))
+	serverOut := make([]byte, len(c.serverData))
+	if c.welcome != nil {
+		clientCrypt, serverCrypt, err := builder(c.protocol, c.welcome)
+		if err != nil {
+			return err
+		}
+		copy(serverOut, c.welcome)
+		headerSize := 8
+		if c.protocol == proxy.ProtocolPatch {
+			headerSize = 4
+		}
+		encodeStream(clientOut, 0, c.clientPackets, clientCrypt, names, headerSize)
+		encodeStream(serverOut, len(c.welcome), c.serverPackets, serverCrypt, names, headerSize)
+		clientOut, serverOut = clientOut[:c.decodedUpTo[0]], serverOut[:c.decodedUpTo[1]]
+	} else {
+		clientOut, serverOut = nil, nil
+	}
+	c.client.overwrite(clientOut)
+	c.server.overwrite(serverOut)
+	return nil
+}
+
+func encodeStream(out []byte, offset int, packets []*proxy.PacketMsg, crypt proxy.Crypt, names *pseudonyms,
+	headerSize int) {
+	for _, packet := range packets {
+		data := names.anonymize(packet, headerSize)
+		crypt.Encrypt(data, uint32(len(data)))
+		copy(out[offset:], data)
+		offset += len(data)
+	}
+}
+
+// Replaces the client's address in the frame's network header.
+func rewriteAddresses(f *frame, names *pseudonyms) {
+	var src, dst net.IP
+	switch ip := f.network.(type) {
+	case *layers.IPv4:
+		src, dst = ip.SrcIP, ip.DstIP
+	case *layers.IPv6:
+		src, dst = ip.SrcIP, ip.DstIP
+	default:
+		return
+	}
+	for _, addr := range []net.IP{src, dst} {
+		if mapped, ok := names.clientIPs[addr.String()]; ok && len(mapped) == len(addr) {
+			copy(addr, mapped)
+		}
+	}
+}
+
+// Recomputes the IPv4 header and TCP checksums after the frame was changed.
+// Frames truncated by the capture's snap length are left alone.
+func fixChecksums(f *frame) {
+	if f.ci.CaptureLength < f.ci.Length {
+		return
+	}
+	if len(f.tcp.Contents) < 18 {
+		return
+	}
+	tcpData := make([]byte, 0, len(f.tcp.Contents)+len(f.tcp.Payload))
+	tcpData = append(append(tcpData, f.tcp.Contents...), f.tcp.Payload...)
+	var pseudo []byte
+	switch ip := f.network.(type) {
+	case *layers.IPv4:
+		header := ip.Contents
+		if len(header) >= 12 {
+			header[10], header[11] = 0, 0
+			binary.BigEndian.PutUint16(header[10:], checksum(header, 0))
+		}
+		pseudo = append(append(append([]byte(nil), ip.SrcIP.To4()...), ip.DstIP.To4()...),
+			0, byte(layers.IPProtocolTCP), byte(len(tcpData)>>8), byte(len(tcpData)))
+	case *layers.IPv6:
+		pseudo = append(append([]byte(nil), ip.SrcIP.To16()...), ip.DstIP.To16()...)
+		pseudo = append(pseudo, byte(len(tcpData)>>24), byte(len(tcpData)>>16), byte(len(tcpData)>>8),
+			byte(len(tcpData)), 0, 0, 0, byte(layers.IPProtocolTCP))
+	default:
+		return
+	}
+	tcpData[16], tcpData[17] = 0, 0
+	sum := checksum(tcpData, ^checksum(pseudo, 0))
+	binary.BigEndian.PutUint16(f.tcp.Contents[16:], sum)
+}
+
+// Returns the ones' complement checksum of data, continuing from a previous
+// uncomplemented sum.
+func checksum(data []byte, initial uint16) uint16 {
+	sum := uint32(initial)
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xFFFF {
+		sum = sum&0xFFFF + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,248 @@
+// Package capture decodes PSO sessions from traffic recorded outside of the
+// proxy, such as tcpdump or Wireshark captures.
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/google/gopacket/tcpassembly"
+
+	"github.com/dcrodman/bb_reverse_proxy/proxy"
+)
+
+// Block type that starts every pcapng file.
+var pcapngMagic = []byte{0x0A, 0x0D, 0x0D, 0x0A}
+
+// ImportConfig controls how captured traffic is decoded.
+type ImportConfig struct {
+	// Maps the server side port of PSO connections to the name of the server
+	// running on it. Connections on any other port are ignored.
+	Ports map[uint16]string
+	// Destinations for the decoded packets.
+	Sinks []proxy.Sink
+	// Fields masked in the packets given to the sinks. Defaults to
+	// proxy.DefaultRedactedFields() unless DisableRedaction is set.
+	RedactedFields   []proxy.RedactedField
+	DisableRedaction bool
+	// Defaults to proxy.BuildCrypts.
+	CryptBuilder proxy.CryptBuilder
+	// Vectors recorded by the proxy, used to decode sessions whose welcome
+	// packet isn't in the capture.
+	KeyLog []proxy.KeyLogEntry
+	// Used for status messages about the capture. Defaults to stderr.
+	Logger *log.Logger
+	// The last session ID handed out, which each new session increments. Sinks
+	// key their state on session IDs, so imports that share sinks should share
+	// this too. Defaults to numbering the import's sessions from 1.
+	LastSessionID *uint64
+}
+
+// DefaultPorts maps both the proxy and server ports of proxy.DefaultProxies to
+// their server names, so that captures taken on either side of the proxy work.
+func DefaultPorts() map[uint16]string {
+	ports := make(map[uint16]string)
+	for _, pc := range proxy.DefaultProxies("", "") {
+		for _, addr := range []string{pc.Host, pc.RemoteHost} {
+			_, portStr, _ := net.SplitHostPort(addr)
+			port, _ := strconv.ParseUint(portStr, 10, 16)
+			ports[uint16(port)] = pc.ServerName
+		}
+	}
+	return ports
+}
+
+// ParsePorts parses a comma separated list of port=SERVER pairs, such as
+// "12000=LOGIN,12001=CHARACTER", into a port map.
+func ParsePorts(value string) (map[uint16]string, error) {
+	ports := make(map[uint16]string)
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected port=SERVER, got %q", entry)
+		}
+		port, err := strconv.ParseUint(parts[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", parts[0])
+		}
+		ports[uint16(port)] = parts[1]
+	}
+	return ports, nil
+}
+
+// packetReader is satisfied by both the pcap and pcapng readers.
+type packetReader interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+}
+
+// ImportFile decodes the PSO sessions in the pcap or pcapng file at path.
+func ImportFile(path string, config ImportConfig) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return Import(file, config)
+}
+
+// Import reads a pcap or pcapng capture from r, reassembles the TCP streams on
+// the configured ports and writes every packet that can be decrypted to the
+// configured sinks in the order in which they were captured.
+func Import(r io.Reader, config ImportConfig) error {
+	if config.CryptBuilder == nil {
+		config.CryptBuilder = proxy.BuildCrypts
+	}
+	if config.Logger == nil {
+		config.Logger = log.New(os.Stderr, "", log.Ltime)
+	}
+	if config.LastSessionID == nil {
+		config.LastSessionID = new(uint64)
+	}
+	if config.RedactedFields == nil {
+		config.RedactedFields = proxy.DefaultRedactedFields()
+	}
+	var redactor *proxy.Redactor
+	if !config.DisableRedaction {
+		redactor = proxy.NewRedactor(config.RedactedFields)
+	}
+
+	reader, err := newPacketReader(r)
+	if err != nil {
+		return err
+	}
+
+	factory := &sessionFactory{
+		config:   config,
+		redactor: redactor,
+		sessions: make(map[string]*session),
+		keys:     make(map[string]*proxy.KeyLogEntry),
+	}
+	for i := range config.KeyLog {
+		entry := &config.KeyLog[i]
+		factory.keys[entry.Client+"-"+entry.Server] = entry
+	}
+	assembler := tcpassembly.NewAssembler(tcpassembly.NewStreamPool(factory))
+	for {
+		data, ci, err := reader.ReadPacketData()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read capture: %s", err.Error())
+		}
+
+		packet := gopacket.NewPacket(data, reader.LinkType(), gopacket.Default)
+		netLayer := packet.NetworkLayer()
+		tcp, ok := packet.TransportLayer().(*layers.TCP)
+		if netLayer == nil || !ok {
+			continue
+		}
+		if factory.serverName(tcp) == "" {
+			continue
+		}
+		assembler.AssembleWithTimestamp(netLayer.NetworkFlow(), tcp, ci.Timestamp)
+	}
+	assembler.FlushAll()
+	return nil
+}
+
+func newPacketReader(r io.Reader) (packetReader, error) {
+	buffered := bufio.NewReader(r)
+	magic, err := buffered.Peek(len(pcapngMagic))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read capture header: %s", err.Error())
+	}
+	if bytes.Equal(magic, pcapngMagic) {
+		return pcapgo.NewNgReader(buffered, pcapgo.DefaultNgReaderOptions)
+	}
+	return pcapgo.NewReader(buffered)
+}
+
+// Creates a stream for each direction of a connection and pairs them up into
+// sessions.
+type sessionFactory struct {
+	config   ImportConfig
+	redactor *proxy.Redactor
+	sessions map[string]*session
+	// Key log entries by client and server address.
+	keys map[string]*proxy.KeyLogEntry
+}
+
+// Returns the name of the server on the PSO port of the segment, if it has one.
+func (f *sessionFactory) serverName(tcp *layers.TCP) string {
+	if name, ok := f.config.Ports[uint16(tcp.SrcPort)]; ok {
+		return name
+	}
+	return f.config.Ports[uint16(tcp.DstPort)]
+}
+
+func (f *sessionFactory) New(netFlow, tcpFlow gopacket.Flow) tcpassembly.Stream {
+	srcPort, dstPort := portOf(tcpFlow.Src()), portOf(tcpFlow.Dst())
+	fromServer := f.config.Ports[srcPort] != ""
+
+	// Key the session on the client and server endpoints in that order so that
+	// both directions find it. The addresses are formatted the same way as the
+	// proxy writes them to the key log.
+	client := net.JoinHostPort(netFlow.Src().String(), strconv.Itoa(int(srcPort)))
+	server := net.JoinHostPort(netFlow.Dst().String(), strconv.Itoa(int(dstPort)))
+	serverPort := dstPort
+	if fromServer {
+		client, server = server, client
+		serverPort = srcPort
+	}
+	key := client + "-" + server
+
+	s, ok := f.sessions[key]
+	if !ok {
+		*f.config.LastSessionID++
+		s = newSession(f.config, f.redactor, *f.config.LastSessionID, f.config.Ports[serverPort], client, server, f.keys[key])
+		f.sessions[key] = s
+	}
+	return &stream{session: s, fromServer: fromServer, factory: f, key: key}
+}
+
+func portOf(endpoint gopacket.Endpoint) uint16 {
+	raw := endpoint.Raw()
+	if len(raw) != 2 {
+		return 0
+	}
+	return uint16(raw[0])<<8 | uint16(raw[1])
+}
+
+// One direction of a TCP connection.
+type stream struct {
+	session    *session
+	fromServer bool
+	factory    *sessionFactory
+	key        string
+	started    bool
+}
+
+func (st *stream) Reassembled(reassemblies []tcpassembly.Reassembly) {
+	for _, r := range reassemblies {
+		// Captures that begin after the SYN report an unknown skip on the first
+		// segment, which is fine as long as the stream turns out to begin there.
+		gap := r.Skip != 0 && st.started
+		if len(r.Bytes) > 0 {
+			st.started = true
+		}
+		st.session.write(st.fromServer, r, gap)
+	}
+}
+
+func (st *stream) ReassemblyComplete() {
+	st.session.closed++
+	if st.session.closed == 2 {
+		delete(st.factory.sessions, st.key)
+	}
+}
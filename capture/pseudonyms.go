@@ -0,0 +1,260 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"unicode/utf16"
+
+	"github.com/dcrodman/bb_reverse_proxy/proxy"
+)
+
+// Identifiers shorter than these are too likely to turn up by chance to be
+// replaced wherever they appear.
+const (
+	minUsernameLength = 3
+	minNameLength     = 2
+	minGuildcard      = 100000
+)
+
+// Offsets of the identifiers learned from packets.
+const (
+	bbUsernameOffset     = 0x1C
+	patchUsernameOffset  = 0x10
+	usernameLength       = 0x10
+	patchPasswordOffset  = 0x20
+	securityGuildcardOff = 0x10
+	previewNameOffset    = 0x68
+	nameLength           = 0x20
+)
+
+// Layout of the guild card file sent in 0x02DC chunks.
+const (
+	guildcardChunkSize   = 0x6800
+	guildcardEntriesFrom = 0x114 + 0x1DE8 + 0x78
+	guildcardEntrySize   = 0x1BC
+	guildcardEntryCount  = 104
+)
+
+// Fields masked outright rather than replaced with a pseudonym.
+var anonymizedFields = []string{"password", "hwid", "security"}
+
+// pseudonyms consistently maps the identifiers found in a capture to made up
+// values of the same length, so that packets can be rewritten in place.
+type pseudonyms struct {
+	clientIPs  map[string]net.IP
+	usernames  map[string]string
+	guildcards map[uint32]uint32
+	names      map[string]string
+
+	redactor     *proxy.Redactor
+	replacements []replacement
+}
+
+// A byte sequence to replace wherever it appears in packet data.
+type replacement struct {
+	from, to []byte
+}
+
+func newPseudonyms() *pseudonyms {
+	fields, _ := proxy.RedactedFieldsNamed(anonymizedFields)
+	return &pseudonyms{
+		clientIPs:  make(map[string]net.IP),
+		usernames:  make(map[string]string),
+		guildcards: make(map[uint32]uint32),
+		names:      make(map[string]string),
+		redactor:   proxy.NewRedactor(fields),
+	}
+}
+
+// Returns the pseudonym for a client's IP address, from 10.0.0.0/8 or fd00::/8.
+func (p *pseudonyms) clientIP(ip net.IP) net.IP {
+	if mapped, ok := p.clientIPs[ip.String()]; ok {
+		return mapped
+	}
+	n := len(p.clientIPs) + 1
+	var mapped net.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		mapped = net.IPv4(10, byte(n>>16), byte(n>>8), byte(n)).To4()
+	} else {
+		mapped = make(net.IP, net.IPv6len)
+		mapped[0] = 0xFD
+		binary.BigEndian.PutUint32(mapped[12:], uint32(n))
+	}
+	p.clientIPs[ip.String()] = mapped
+	return mapped
+}
+
+// Records any identifiers in a decoded packet.
+func (p *pseudonyms) learn(packet *proxy.PacketMsg) {
+	data := packet.DecryptedData
+	if packet.Protocol == proxy.ProtocolPatch {
+		if packet.Command == 0x04 && packet.FromName == "Client" && len(data) >= patchUsernameOffset+usernameLength {
+			p.learnUsername(cString(data[patchUsernameOffset : patchUsernameOffset+usernameLength]))
+		}
+		return
+	}
+
+	switch {
+	case packet.Command == 0x93 && packet.FromName == "Client" && len(data) >= bbUsernameOffset+usernameLength:
+		p.learnUsername(cString(data[bbUsernameOffset : bbUsernameOffset+usernameLength]))
+	case packet.Command == 0xE6 && packet.FromName == "Server" && len(data) >= securityGuildcardOff+4:
+		p.learnGuildcard(binary.LittleEndian.Uint32(data[securityGuildcardOff:]))
+	case packet.Command == 0xE5 && len(data) >= previewNameOffset+nameLength:
+		p.learnName(utf16Units(data[previewNameOffset : previewNameOffset+nameLength]))
+	case packet.Command == 0x02DC && packet.FromName == "Server":
+		p.learnGuildcardChunk(data)
+	}
+	if msg := proxy.DecodeChat(packet); msg != nil {
+		p.learnGuildcard(msg.Guildcard)
+		p.learnGuildcard(msg.To)
+		p.learnName(utf16.Encode([]rune(msg.Name)))
+	}
+}
+
+// Learns the guild card numbers, names and team names of the guild card file
+// entries that lie entirely within a chunk.
+func (p *pseudonyms) learnGuildcardChunk(data []byte) {
+	if len(data) < 16 {
+		return
+	}
+	chunk := binary.LittleEndian.Uint32(data[12:])
+	chunkData := data[16:]
+	start := int(chunk) * guildcardChunkSize
+	for i := 0; i < guildcardEntryCount; i++ {
+		offset := guildcardEntriesFrom + i*guildcardEntrySize - start
+		if offset < 0 || offset+guildcardEntrySize > len(chunkData) {
+			continue
+		}
+		entry := chunkData[offset:]
+		p.learnGuildcard(binary.LittleEndian.Uint32(entry))
+		p.learnName(utf16Units(entry[4:52]))
+		p.learnName(utf16Units(entry[52:84]))
+	}
+}
+
+func (p *pseudonyms) learnUsername(username string) {
+	if len(username) < minUsernameLength || p.usernames[username] != "" {
+		return
+	}
+	pseudonym := pseudonym("user", len(p.usernames)+1, len(username))
+	p.usernames[username] = pseudonym
+	p.replace([]byte(username), []byte(pseudonym))
+}
+
+func (p *pseudonyms) learnGuildcard(guildcard uint32) {
+	if guildcard < minGuildcard {
+		return
+	}
+	if _, ok := p.guildcards[guildcard]; ok {
+		return
+	}
+	digits := len(strconv.FormatUint(uint64(guildcard), 10))
+	base := uint32(1)
+	for i := 1; i < digits; i++ {
+		base *= 10
+	}
+	pseudonym := base + uint32(len(p.guildcards)) + 1
+	p.guildcards[guildcard] = pseudonym
+
+	from, to := make([]byte, 4), make([]byte, 4)
+	binary.LittleEndian.PutUint32(from, guildcard)
+	binary.LittleEndian.PutUint32(to, pseudonym)
+	p.replace(from, to)
+	fromStr, toStr := strconv.FormatUint(uint64(guildcard), 10), strconv.FormatUint(uint64(pseudonym), 10)
+	p.replace([]byte(fromStr), []byte(toStr))
+	p.replace(utf16Bytes(utf16.Encode([]rune(fromStr))), utf16Bytes(utf16.Encode([]rune(toStr))))
+}
+
+// Learns a character or team name, given as UTF-16 code units.
+func (p *pseudonyms) learnName(units []uint16) {
+	name := string(utf16.Decode(units))
+	if len(units) < minNameLength || p.names[name] != "" {
+		return
+	}
+	pseudonym := pseudonym("Player", len(p.names)+1, len(units))
+	p.names[name] = pseudonym
+	p.replace(utf16Bytes(units), utf16Bytes(utf16.Encode([]rune(pseudonym))))
+}
+
+func (p *pseudonyms) replace(from, to []byte) {
+	p.replacements = append(p.replacements, replacement{from: from, to: to})
+	// Longest first so that no replacement clobbers part of a longer one.
+	sort.SliceStable(p.replacements, func(i, j int) bool {
+		return len(p.replacements[i].from) > len(p.replacements[j].from)
+	})
+}
+
+// Returns a copy of the packet's decrypted data with every known identifier
+// replaced and sensitive fields masked. The header is left alone.
+func (p *pseudonyms) anonymize(packet *proxy.PacketMsg, headerSize int) []byte {
+	data := append([]byte(nil), p.redactor.Redact(packet).DecryptedData...)
+	if packet.Protocol == proxy.ProtocolPatch && packet.Command == 0x04 && packet.FromName == "Client" {
+		for i := patchPasswordOffset; i < patchPasswordOffset+usernameLength && i < len(data); i++ {
+			data[i] = '*'
+		}
+	}
+	if len(data) <= headerSize {
+		return data
+	}
+	body := data[headerSize:]
+	for _, r := range p.replacements {
+		for i := 0; ; {
+			j := bytes.Index(body[i:], r.from)
+			if j < 0 {
+				break
+			}
+			copy(body[i+j:], r.to)
+			i += j + len(r.to)
+		}
+	}
+	return data
+}
+
+// Returns a name for the nth identifier that is exactly length characters long,
+// such as "Player0012", shortening the prefix to its first letter or dropping
+// it altogether to make room for the number.
+func pseudonym(prefix string, n, length int) string {
+	digits := len(strconv.Itoa(n))
+	switch {
+	case length >= len(prefix)+digits:
+		return fmt.Sprintf("%s%0*d", prefix, length-len(prefix), n)
+	case length >= 1+digits:
+		return fmt.Sprintf("%s%0*d", prefix[:1], length-1, n)
+	default:
+		s := strconv.Itoa(n)
+		return s[len(s)-length:]
+	}
+}
+
+// Returns the UTF-16LE code units in b up to the first NUL.
+func utf16Units(b []byte) []uint16 {
+	var units []uint16
+	for i := 0; i+1 < len(b); i += 2 {
+		unit := binary.LittleEndian.Uint16(b[i:])
+		if unit == 0 {
+			break
+		}
+		units = append(units, unit)
+	}
+	return units
+}
+
+func utf16Bytes(units []uint16) []byte {
+	b := make([]byte, 0, len(units)*2)
+	for _, unit := range units {
+		b = append(b, byte(unit), byte(unit>>8))
+	}
+	return b
+}
+
+// Converts a fixed size, NUL padded string field to a string.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
@@ -0,0 +1,222 @@
+package capture
+
+import (
+	"io"
+	"time"
+
+	"github.com/google/gopacket/tcpassembly"
+
+	"github.com/dcrodman/bb_reverse_proxy/proxy"
+)
+
+// How much of a stream to buffer while looking for packet boundaries before
+// giving up on it.
+const maxResyncBuffer = 0x10000
+
+// A captured connection between a client and one of the servers.
+type session struct {
+	config     ImportConfig
+	redactor   *proxy.Redactor
+	id         uint64
+	serverName string
+	clientAddr string
+	serverAddr string
+	closed     int
+
+	// The session's vectors from the key log, if it was recorded there.
+	keys *proxy.KeyLogEntry
+	// Server bytes seen before the welcome packet was complete.
+	welcomeBuf []byte
+
+	// Set up from the welcome packet or the key log.
+	protocol    proxy.Protocol
+	clientCrypt proxy.Crypt
+	serverCrypt proxy.Crypt
+
+	clientStream direction
+	serverStream direction
+	failed       bool
+}
+
+// The decoding state of one side of a session.
+type direction struct {
+	name string
+	// Nil until we know where the packets in the stream start.
+	decoder *proxy.StreamDecoder
+	// Bytes waiting on the ciphers or a resync.
+	buf  []byte
+	seen time.Time
+}
+
+func newSession(config ImportConfig, redactor *proxy.Redactor, id uint64, serverName, clientAddr, serverAddr string,
+	keys *proxy.KeyLogEntry) *session {
+	return &session{
+		config:       config,
+		redactor:     redactor,
+		id:           id,
+		serverName:   serverName,
+		clientAddr:   clientAddr,
+		serverAddr:   serverAddr,
+		keys:         keys,
+		clientStream: direction{name: "Client"},
+		serverStream: direction{name: "Server"},
+	}
+}
+
+func (s *session) write(fromServer bool, r tcpassembly.Reassembly, gap bool) {
+	if s.failed || len(r.Bytes) == 0 {
+		return
+	}
+	d := &s.clientStream
+	if fromServer {
+		d = &s.serverStream
+	}
+
+	if gap {
+		// With a hole in the stream there is no telling where the next packet
+		// starts unless we can search for it.
+		if s.clientCrypt == nil || s.protocol != proxy.ProtocolBB {
+			s.fail("capture is missing data from the %s", d.name)
+			return
+		}
+		s.config.Logger.Printf("%s %s stream has a gap; resynchronizing\n", s.serverName, d.name)
+		d.decoder, d.buf = nil, nil
+	}
+
+	if s.clientCrypt == nil {
+		if fromServer {
+			s.welcomeBuf = append(s.welcomeBuf, r.Bytes...)
+			s.serverStream.seen = r.Seen
+			s.handshake(r.Seen)
+		} else {
+			d.buf = append(d.buf, r.Bytes...)
+			d.seen = r.Seen
+			if s.keys != nil {
+				// Clients don't speak before the welcome packet, so the capture
+				// must have started part way through the session.
+				s.useKeyLog()
+			}
+		}
+		return
+	}
+	s.feed(d, r.Bytes, r.Seen)
+}
+
+// Looks for a complete welcome packet at the start of the server's stream and
+// sets up the decoders with the ciphers built from it. Falls back on the key log
+// if the capture doesn't start with one.
+func (s *session) handshake(seen time.Time) {
+	welcome, protocol, err := proxy.ParseWelcome(s.welcomeBuf)
+	if err == io.ErrUnexpectedEOF {
+		return
+	} else if err != nil {
+		if s.keys != nil {
+			s.useKeyLog()
+		} else {
+			s.fail("no welcome packet or key log entry: %s", err.Error())
+		}
+		return
+	}
+	if !s.setCrypts(protocol, welcome) {
+		return
+	}
+	s.config.Logger.Printf("Decoding %s session between %s and %s\n", s.serverName, s.clientAddr, s.serverAddr)
+	s.emit(proxy.NewWelcomePacket(s.serverName, welcome, seen))
+
+	// Both streams start right after the welcome, so there's no need to search.
+	s.clientStream.decoder = proxy.NewStreamDecoder(s.serverName, "Client", protocol, s.clientCrypt)
+	s.serverStream.decoder = proxy.NewStreamDecoder(s.serverName, "Server", protocol, s.serverCrypt)
+
+	rest := s.welcomeBuf[len(welcome):]
+	s.welcomeBuf = nil
+	if len(s.clientStream.buf) > 0 {
+		clientBuf := s.clientStream.buf
+		s.clientStream.buf = nil
+		s.feed(&s.clientStream, clientBuf, s.clientStream.seen)
+	}
+	if len(rest) > 0 {
+		s.feed(&s.serverStream, rest, seen)
+	}
+}
+
+// Sets up the ciphers from the key log for a capture that started part way
+// through the session.
+func (s *session) useKeyLog() {
+	if s.keys.Protocol != proxy.ProtocolBB {
+		s.fail("only BB sessions can be decoded without the welcome packet")
+		return
+	}
+	if !s.setCrypts(s.keys.Protocol, s.keys.Welcome()) {
+		return
+	}
+	s.config.Logger.Printf("Decoding %s session between %s and %s using the key log\n",
+		s.serverName, s.clientAddr, s.serverAddr)
+
+	clientBuf, serverBuf := s.clientStream.buf, s.welcomeBuf
+	s.clientStream.buf, s.welcomeBuf = nil, nil
+	if len(clientBuf) > 0 {
+		s.feed(&s.clientStream, clientBuf, s.clientStream.seen)
+	}
+	if len(serverBuf) > 0 {
+		s.feed(&s.serverStream, serverBuf, s.serverStream.seen)
+	}
+}
+
+func (s *session) setCrypts(protocol proxy.Protocol, welcome []byte) bool {
+	clientCrypt, serverCrypt, err := s.config.CryptBuilder(protocol, welcome)
+	if err != nil {
+		s.fail("unable to build ciphers: %s", err.Error())
+		return false
+	}
+	s.protocol, s.clientCrypt, s.serverCrypt = protocol, clientCrypt, serverCrypt
+	return true
+}
+
+// Decodes data from one side of the session, first searching for the start of
+// a packet if we don't know where one is.
+func (s *session) feed(d *direction, data []byte, seen time.Time) {
+	if d.decoder == nil {
+		d.buf = append(d.buf, data...)
+		d.seen = seen
+		crypt := s.clientCrypt
+		if d == &s.serverStream {
+			crypt = s.serverCrypt
+		}
+		offset, ok := proxy.FindPacketStart(crypt, s.protocol, d.buf)
+		if !ok {
+			if len(d.buf) > maxResyncBuffer {
+				s.fail("unable to find packet boundaries in the %s stream", d.name)
+			}
+			return
+		}
+		s.config.Logger.Printf("Synchronized with %s %s stream after skipping %d bytes\n",
+			s.serverName, d.name, offset)
+		d.decoder = proxy.NewStreamDecoder(s.serverName, d.name, s.protocol, crypt)
+		data, d.buf = d.buf[offset:], nil
+	}
+
+	packets, err := d.decoder.Write(data, seen)
+	for _, packet := range packets {
+		s.emit(packet)
+	}
+	if err != nil {
+		if framingErr, ok := err.(*proxy.FramingError); ok {
+			s.emit(framingErr.Packet(s.serverName, d.name, seen))
+		}
+		s.fail("%s stream desynced: %s", d.name, err.Error())
+	}
+}
+
+func (s *session) emit(packet *proxy.PacketMsg) {
+	packet.SessionID, packet.ClientAddr = s.id, s.clientAddr
+	packet = s.redactor.Redact(packet)
+	for _, sink := range s.config.Sinks {
+		sink.WritePacket(packet)
+	}
+}
+
+func (s *session) fail(format string, args ...interface{}) {
+	s.failed = true
+	s.config.Logger.Printf("Skipping rest of %s session between %s and %s: "+format+"\n",
+		append([]interface{}{s.serverName, s.clientAddr, s.serverAddr}, args...)...)
+}
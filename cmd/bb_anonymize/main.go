@@ -0,0 +1,38 @@
+// Command bb_anonymize rewrites a capture of PSO traffic with pseudonyms in
+// place of client addresses, usernames, guild card numbers and names so that it
+// can be attached to public bug reports.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/dcrodman/bb_reverse_proxy/capture"
+)
+
+var ports = flag.String("ports", "", "comma separated port=SERVER pairs to keep (defaults to the standard ports)")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] in.pcap out.pcap\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	config := capture.AnonymizeConfig{Ports: capture.DefaultPorts()}
+	if *ports != "" {
+		var err error
+		if config.Ports, err = capture.ParsePorts(*ports); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := capture.AnonymizeFile(flag.Arg(0), flag.Arg(1), config); err != nil {
+		log.Fatalf("Unable to anonymize %s: %s", flag.Arg(0), err.Error())
+	}
+}
@@ -0,0 +1,114 @@
+// Command bb_pcap decodes the PSO sessions in pcap or pcapng captures taken with
+// tcpdump or Wireshark, without having to run the proxy.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dcrodman/bb_reverse_proxy/capture"
+	"github.com/dcrodman/bb_reverse_proxy/extract"
+	"github.com/dcrodman/bb_reverse_proxy/output"
+	"github.com/dcrodman/bb_reverse_proxy/proxy"
+)
+
+var (
+	logFile    = flag.String("file", "", "file to which output will be appended")
+	namesOnly  = flag.Bool("nameonly", false, "only print packet names instead of full data")
+	keyLog     = flag.String("keylog", "", "key log written by the proxy, for sessions without a welcome packet")
+	ports      = flag.String("ports", "", "comma separated port=SERVER pairs to decode (defaults to the standard ports)")
+	outDir     = flag.String("outdir", "", "directory in which to write a log file per session along with a manifest")
+	rotateSize = flag.Int64("rotatesize", 0, "rotate log files once they grow past this many bytes (0 to disable)")
+	rotateTime = flag.Duration("rotatetime", 0, "rotate log files once they've been written to for this long (0 to disable)")
+	captureDir = flag.String("capturedir", "", "directory to which files transferred over sessions will be extracted")
+	responses  = flag.Bool("responses", false, "pair requests with their responses and print response time statistics at the end")
+	timeout    = flag.Duration("responsetimeout", 5*time.Second, "warn about requests that get no response within this long")
+	redact     = flag.String("redact", "all", "comma separated sensitive fields to mask in the output (username, password, hwid, security, all)")
+	noRedact   = flag.Bool("noredact", false, "log sensitive fields such as passwords as-is, for local debugging")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] capture.pcap...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	logger := log.New(os.Stderr, "", log.Ltime)
+	if *logFile != "" {
+		file, err := output.OpenRotatingFile(*logFile, *rotateSize, *rotateTime)
+		if err != nil {
+			log.Fatalf("Unable to open log file: %s", err.Error())
+		}
+		logger.SetOutput(file)
+	}
+
+	config := capture.ImportConfig{
+		Ports:            capture.DefaultPorts(),
+		Sinks:            []proxy.Sink{proxy.NewLogSink(logger, *namesOnly)},
+		DisableRedaction: *noRedact,
+		// Keeps the sessions of each capture apart.
+		LastSessionID: new(uint64),
+	}
+	if *outDir != "" {
+		sessionSink, err := output.NewSessionSink(*outDir, logger)
+		if err != nil {
+			log.Fatalf("Unable to set up output directory: %s", err.Error())
+		}
+		sessionSink.NamesOnly, sessionSink.MaxSize, sessionSink.MaxAge = *namesOnly, *rotateSize, *rotateTime
+		config.Sinks = []proxy.Sink{sessionSink}
+	}
+	var err error
+	if !*noRedact {
+		config.RedactedFields, err = proxy.RedactedFieldsNamed(strings.Split(*redact, ","))
+		if err == proxy.ErrNoRedactedFields {
+			log.Fatal("-redact needs at least one field; use -noredact to turn redaction off")
+		} else if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *captureDir != "" {
+		config.Sinks = append(config.Sinks, extract.Sinks(*captureDir, logger)...)
+	}
+	var tracker *proxy.ResponseTracker
+	if *responses {
+		tracker = proxy.NewResponseTracker(logger, *timeout)
+		config.Sinks = append(config.Sinks, tracker)
+	}
+	if *ports != "" {
+		if config.Ports, err = capture.ParsePorts(*ports); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *keyLog != "" {
+		file, err := os.Open(*keyLog)
+		if err != nil {
+			log.Fatalf("Unable to open key log: %s", err.Error())
+		}
+		config.KeyLog, err = proxy.ReadKeyLog(file)
+		file.Close()
+		if err != nil {
+			log.Fatalf("Unable to read key log: %s", err.Error())
+		}
+	}
+
+	for _, path := range flag.Args() {
+		if err := capture.ImportFile(path, config); err != nil {
+			log.Fatalf("Unable to import %s: %s", path, err.Error())
+		}
+	}
+	if tracker != nil {
+		// Anything still waiting at the end of the capture never got a response.
+		tracker.Expire(time.Now())
+		tracker.WriteReport(os.Stdout)
+	}
+}
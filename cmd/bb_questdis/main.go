@@ -0,0 +1,44 @@
+// Command bb_questdis prints a listing of the script in BB quest .bin files,
+// such as those extracted by the proxy with -capturedir.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/dcrodman/bb_reverse_proxy/prs"
+	"github.com/dcrodman/bb_reverse_proxy/quest"
+)
+
+var compressed = flag.Bool("prs", true, "the files are PRS compressed, as sent to the client")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] quest.bin...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	for _, path := range flag.Args() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Unable to read %s: %s", path, err.Error())
+		}
+		if *compressed {
+			if data, err = prs.Decompress(data); err != nil {
+				log.Fatalf("Unable to decompress %s: %s", path, err.Error())
+			}
+		}
+		listing, err := quest.Disassemble(data)
+		if err != nil {
+			log.Fatalf("Unable to disassemble %s: %s", path, err.Error())
+		}
+		fmt.Print(listing)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dcrodman/bb_reverse_proxy/extract"
+	"github.com/dcrodman/bb_reverse_proxy/output"
+	"github.com/dcrodman/bb_reverse_proxy/proxy"
+)
+
+var (
+	host       = flag.String("host", "127.0.0.1", "host on which the proxy will listen")
+	advertise  = flag.String("advertise", "", "IPv4 address or hostname sent to clients in redirects (defaults to -host)")
+	serverHost = flag.String("serverhost", "127.0.0.1", "host on which the server is listening, or a comma separated list of them to balance sessions across")
+	shadowHost = flag.String("shadowhost", "", "host of a second server, on the same ports, to also send each session to and compare responses with")
+	logFile    = flag.String("file", "", "file to which output will be appended")
+	outDir     = flag.String("outdir", "", "directory in which to write a log file per session along with a manifest")
+	rotateSize = flag.Int64("rotatesize", 0, "rotate log files once they grow past this many bytes (0 to disable)")
+	rotateTime = flag.Duration("rotatetime", 0, "rotate log files once they've been written to for this long (0 to disable)")
+	namesOnly  = flag.Bool("nameonly", false, "only print packet names instead of full data")
+	debugMode  = flag.Bool("debug", false, "verbose logging for dev")
+
+	dialRetries = flag.Int("dialretries", 2, "number of times to retry connecting to the server")
+	balance     = flag.String("balance", "roundrobin", "how to pick between several -serverhost hosts (roundrobin, leastsessions)")
+	sendProxy   = flag.String("proxyprotocol", "", "send a PROXY protocol header (v1 or v2) to the server so that it sees each client's address")
+	acceptProxy = flag.Bool("acceptproxyprotocol", false, "expect a PROXY protocol header from a load balancer on every client connection")
+	healthCheck = flag.Duration("healthcheck", 10*time.Second, "how often to check that each of several -serverhost hosts is up")
+	maxSessions = flag.Int("maxsessions", 0, "maximum concurrent sessions per proxy (0 for no limit)")
+	reencrypt   = flag.Bool("reencrypt", false, "use separate encryption vectors with the client and re-encrypt every packet")
+	keyLogFile  = flag.String("keylog", "", "file to which session encryption vectors will be appended")
+	metricsAddr = flag.String("metrics", "", "address on which to serve Prometheus metrics at /metrics")
+	controlAddr = flag.String("control", "", "address on which to serve the control API under /control/")
+	impair      = flag.String("impair", "", "network conditions to simulate in both directions, e.g. latency=200ms,jitter=50ms,bandwidth=8192")
+	impairC     = flag.String("impairclient", "", "network conditions to simulate on packets from the client (overrides -impair)")
+	impairS     = flag.String("impairserver", "", "network conditions to simulate on packets from the server (overrides -impair)")
+	responses   = flag.Bool("responses", false, "pair requests with their responses and serve response time statistics under /control/responses")
+	respTimeout = flag.Duration("responsetimeout", 5*time.Second, "warn about requests that get no response within this long")
+	captureDir  = flag.String("capturedir", "", "directory to which files transferred over sessions will be extracted")
+	redact      = flag.String("redact", "all", "comma separated sensitive fields to mask in the output (username, password, hwid, security, all)")
+	noRedact    = flag.Bool("noredact", false, "log sensitive fields such as passwords as-is, for local debugging")
+)
+
+// Repeatable -advertise-subnet flag values in the form CIDR=host.
+type subnetFlags []proxy.SubnetAddress
+
+func (f *subnetFlags) String() string {
+	var parts []string
+	for _, entry := range *f {
+		parts = append(parts, entry.Subnet+"="+entry.Host)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *subnetFlags) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected CIDR=host, got %q", value)
+	}
+	*f = append(*f, proxy.SubnetAddress{Subnet: parts[0], Host: parts[1]})
+	return nil
+}
+
+func main() {
+	var advertiseSubnets subnetFlags
+	flag.Var(&advertiseSubnets, "advertise-subnet",
+		"CIDR=host; advertise host in redirects to clients in CIDR (repeatable)")
+	flag.Parse()
+	logger := log.New(os.Stderr, "", log.Ltime)
+
+	if *logFile != "" {
+		file, err := output.OpenRotatingFile(*logFile, *rotateSize, *rotateTime)
+		if err != nil {
+			log.Fatalf("Unable to open log file: %s", err.Error())
+		}
+		logger.SetOutput(file)
+	}
+
+	var keyLog io.Writer
+	if *keyLogFile != "" {
+		file, err := os.OpenFile(*keyLogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatalf("Unable to open key log file: %s", err.Error())
+		}
+		keyLog = file
+	}
+
+	var sinks []proxy.Sink
+	if *outDir != "" {
+		sessionSink, err := output.NewSessionSink(*outDir, logger)
+		if err != nil {
+			log.Fatalf("Unable to set up output directory: %s", err.Error())
+		}
+		sessionSink.NamesOnly, sessionSink.MaxSize, sessionSink.MaxAge = *namesOnly, *rotateSize, *rotateTime
+		sinks = append(sinks, sessionSink)
+	} else {
+		sinks = append(sinks, proxy.NewLogSink(logger, *namesOnly))
+	}
+	if *captureDir != "" {
+		sinks = append(sinks, extract.Sinks(*captureDir, logger)...)
+	}
+	var tracker *proxy.ResponseTracker
+	if *responses {
+		if *controlAddr == "" {
+			log.Fatal("-responses serves its statistics on the control API; set -control too")
+		}
+		tracker = proxy.NewResponseTracker(logger, *respTimeout)
+		sinks = append(sinks, tracker)
+		// Catch requests that time out while their sessions are quiet.
+		go func() {
+			for now := range time.Tick(time.Second) {
+				tracker.Expire(now)
+			}
+		}()
+	}
+
+	var redactedFields []proxy.RedactedField
+	var err error
+	if !*noRedact {
+		redactedFields, err = proxy.RedactedFieldsNamed(strings.Split(*redact, ","))
+		if err == proxy.ErrNoRedactedFields {
+			log.Fatal("-redact needs at least one field; use -noredact to turn redaction off")
+		} else if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	impairments := make(map[string]proxy.Impairment)
+	for direction, spec := range map[string]string{"Client": *impairC, "Server": *impairS} {
+		if spec == "" {
+			spec = *impair
+		}
+		if impairments[direction], err = proxy.ParseImpairment(spec); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	balancing, err := proxy.ParseBalancing(*balance)
+	if err != nil {
+		log.Fatal(err)
+	}
+	proxyProtocol, err := proxy.ParseProxyProtocol(*sendProxy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	serverHosts := strings.Split(*serverHost, ",")
+	proxies := proxy.DefaultProxies(*host, serverHosts[0])
+	if len(serverHosts) > 1 {
+		for _, h := range serverHosts {
+			for n, upstream := range proxy.DefaultProxies(*host, strings.TrimSpace(h)) {
+				proxies[n].RemoteHosts = append(proxies[n].RemoteHosts, upstream.RemoteHost)
+			}
+		}
+	}
+	if *shadowHost != "" {
+		for n, shadow := range proxy.DefaultProxies(*host, *shadowHost) {
+			proxies[n].ShadowHost = shadow.RemoteHost
+		}
+	}
+
+	server, err := proxy.NewServer(proxy.Config{
+		Host:                *host,
+		AdvertisedHost:      *advertise,
+		AdvertisedSubnets:   advertiseSubnets,
+		Proxies:             proxies,
+		Sinks:               sinks,
+		RedactedFields:      redactedFields,
+		DisableRedaction:    *noRedact,
+		Logger:              logger,
+		DialRetries:         *dialRetries,
+		Balancing:           balancing,
+		HealthCheckInterval: *healthCheck,
+		SendProxyProtocol:   proxyProtocol,
+		AcceptProxyProtocol: *acceptProxy,
+		MaxSessions:         *maxSessions,
+		Impairments:         impairments,
+		KeyLog:              keyLog,
+		TerminateEncryption: *reencrypt,
+		Debug:               *debugMode,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The metrics and control API share a listener if given the same address.
+	muxes := make(map[string]*http.ServeMux)
+	handle := func(addr, pattern string, handler http.Handler) {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		muxes[addr].Handle(pattern, handler)
+	}
+	if *metricsAddr != "" {
+		handle(*metricsAddr, "/metrics", server.MetricsHandler())
+	}
+	if *controlAddr != "" {
+		handle(*controlAddr, "/control/", http.StripPrefix("/control", server.ControlHandler()))
+		if tracker != nil {
+			handle(*controlAddr, "/control/responses", tracker)
+		}
+	}
+	for addr, mux := range muxes {
+		addr, mux := addr, mux
+		go func() {
+			log.Fatal(http.ListenAndServe(addr, mux))
+		}()
+	}
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatal(err)
+	}
+}
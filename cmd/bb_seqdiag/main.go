@@ -0,0 +1,101 @@
+// Command bb_seqdiag draws the PSO sessions in pcap or pcapng captures as
+// Mermaid or PlantUML sequence diagrams.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/dcrodman/bb_reverse_proxy/capture"
+	"github.com/dcrodman/bb_reverse_proxy/proxy"
+	"github.com/dcrodman/bb_reverse_proxy/sequence"
+)
+
+var (
+	format    = flag.String("format", "mermaid", "diagram syntax: mermaid or plantuml")
+	sessionID = flag.Uint64("session", 0, "session to draw (defaults to the first)")
+	hops      = flag.Bool("hops", false, "also draw the player's other sessions, matched by client address and guild card, following them from LOGIN through to BLOCK")
+	list      = flag.Bool("list", false, "list the sessions in the capture instead of drawing one")
+	outFile   = flag.String("o", "", "file to which the diagram will be written instead of stdout")
+	keyLog    = flag.String("keylog", "", "key log written by the proxy, for sessions without a welcome packet")
+	ports     = flag.String("ports", "", "comma separated port=SERVER pairs to decode (defaults to the standard ports)")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] capture.pcap...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	diagramFormat, err := sequence.ParseFormat(*format)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	recorder := sequence.NewRecorder()
+	config := capture.ImportConfig{
+		Ports: capture.DefaultPorts(),
+		Sinks: []proxy.Sink{recorder},
+		// Keeps the sessions of each capture apart.
+		LastSessionID: new(uint64),
+	}
+	if *ports != "" {
+		if config.Ports, err = capture.ParsePorts(*ports); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *keyLog != "" {
+		file, err := os.Open(*keyLog)
+		if err != nil {
+			log.Fatalf("Unable to open key log: %s", err.Error())
+		}
+		config.KeyLog, err = proxy.ReadKeyLog(file)
+		file.Close()
+		if err != nil {
+			log.Fatalf("Unable to read key log: %s", err.Error())
+		}
+	}
+	for _, path := range flag.Args() {
+		if err := capture.ImportFile(path, config); err != nil {
+			log.Fatalf("Unable to import %s: %s", path, err.Error())
+		}
+	}
+
+	sessions := recorder.Sessions()
+	if *list {
+		for _, session := range sessions {
+			fmt.Printf("%d\t%s\t%s\t%s\t%d\t%d packets\n", session.ID, session.Start.Format("2006-01-02 15:04:05"),
+				session.Server, session.Client, session.Guildcard, session.Packets)
+		}
+		return
+	}
+	if len(sessions) == 0 {
+		log.Fatal("No PSO sessions found")
+	}
+	if *sessionID == 0 {
+		*sessionID = sessions[0].ID
+	}
+	ids := []uint64{*sessionID}
+	if *hops {
+		if ids = recorder.Correlated(*sessionID); ids == nil {
+			log.Fatalf("No session %d", *sessionID)
+		}
+	}
+
+	out := os.Stdout
+	if *outFile != "" {
+		if out, err = os.Create(*outFile); err != nil {
+			log.Fatalf("Unable to create %s: %s", *outFile, err.Error())
+		}
+		defer out.Close()
+	}
+	if err := recorder.Write(out, diagramFormat, ids); err != nil {
+		log.Fatal(err)
+	}
+}
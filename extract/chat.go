@@ -0,0 +1,47 @@
+package extract
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/dcrodman/bb_reverse_proxy/proxy"
+)
+
+const transcriptTimeFormat = "2006-01-02 15:04:05.000"
+
+// TranscriptSink appends every chat message, simple mail and server message on
+// a session to chat.txt in the session's directory in Dir. Chat comes from the
+// server's side of the session since the server relays each message back to
+// its sender along with the speaker's name; mail is recorded in both
+// directions.
+type TranscriptSink struct {
+	Dir    string
+	Logger *log.Logger
+}
+
+// NewTranscriptSink returns a TranscriptSink writing transcripts under dir.
+func NewTranscriptSink(dir string, logger *log.Logger) *TranscriptSink {
+	return &TranscriptSink{Dir: dir, Logger: logger}
+}
+
+// WritePacket adds the packet's text, if it has any, to the session's transcript.
+func (sink *TranscriptSink) WritePacket(packet *proxy.PacketMsg) {
+	msg := proxy.DecodeChat(packet)
+	if msg == nil || packet.FromName == proxy.ShadowName || (msg.Channel != "mail" && packet.FromName != "Server") {
+		return
+	}
+	dir := SessionDir(sink.Dir, packet)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		sink.Logger.Printf("Failed to create %s: %s\n", dir, err.Error())
+		return
+	}
+	file, err := os.OpenFile(filepath.Join(dir, "chat.txt"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		sink.Logger.Printf("Failed to open chat transcript: %s\n", err.Error())
+		return
+	}
+	defer file.Close()
+	fmt.Fprintf(file, "%s %s %s\n", packet.Timestamp.Format(transcriptTimeFormat), packet.FromName, msg)
+}
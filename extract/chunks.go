@@ -0,0 +1,49 @@
+package extract
+
+// Size of the data in each chunk of a parameter or guild card file.
+const chunkSize = 0x6800
+
+// A file that the server splits into numbered chunks, sent one at a time as the
+// client requests them.
+type chunkedFile struct {
+	chunks map[uint32][]byte
+}
+
+func newChunkedFile() *chunkedFile {
+	return &chunkedFile{chunks: make(map[uint32][]byte)}
+}
+
+// Keeps a copy of the chunk's data, since packets are reused once forwarded.
+func (f *chunkedFile) add(chunk uint32, data []byte) {
+	f.chunks[chunk] = append([]byte(nil), data...)
+}
+
+// Returns the first size bytes of the file if all of them have arrived,
+// otherwise nil. Nothing is allocated until every chunk is known to be there,
+// since size comes off of the wire and is checked on every chunk.
+func (f *chunkedFile) assemble(size uint32) []byte {
+	if size > maxFileSize {
+		return nil
+	}
+	var chunks uint32
+	for received := 0; received < int(size); chunks++ {
+		chunkData, ok := f.chunks[chunks]
+		if !ok {
+			return nil
+		}
+		if len(chunkData) > chunkSize {
+			chunkData = chunkData[:chunkSize]
+		}
+		received += len(chunkData)
+	}
+
+	data := make([]byte, 0, int(chunks)*chunkSize)
+	for chunk := uint32(0); chunk < chunks; chunk++ {
+		chunkData := f.chunks[chunk]
+		if len(chunkData) > chunkSize {
+			chunkData = chunkData[:chunkSize]
+		}
+		data = append(data, chunkData...)
+	}
+	return data[:size]
+}
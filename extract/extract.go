@@ -0,0 +1,74 @@
+// Package extract contains sinks that reassemble the files transferred over a
+// session, such as parameter files and quests, from the intercepted packets.
+package extract
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dcrodman/bb_reverse_proxy/proxy"
+)
+
+// Sinks returns every extractor, writing files under dir.
+func Sinks(dir string, logger *log.Logger) []proxy.Sink {
+	return []proxy.Sink{
+		NewParameterSink(dir, logger),
+		NewGuildcardSink(dir, logger),
+		NewQuestSink(dir, logger),
+		NewTranscriptSink(dir, logger),
+	}
+}
+
+// The 8 byte header at the start of every BB packet.
+type bbHeader struct {
+	Size  uint16
+	Type  uint16
+	Flags uint32
+}
+
+const bbHeaderSize = 8
+
+// Largest file that will be reassembled. Sizes come off of the wire, so anything
+// claiming to be bigger is taken to be a corrupt header rather than allocated.
+const maxFileSize = 16 << 20
+
+// Returns the packet's contents following the header, trimmed of any padding.
+func packetBody(packet *proxy.PacketMsg, header bbHeader) []byte {
+	end := int(header.Size)
+	if end > len(packet.DecryptedData) {
+		end = len(packet.DecryptedData)
+	}
+	if end < bbHeaderSize {
+		return nil
+	}
+	return packet.DecryptedData[bbHeaderSize:end]
+}
+
+// SessionDir returns the directory under dir in which files extracted from the
+// packet's session are written.
+func SessionDir(dir string, packet *proxy.PacketMsg) string {
+	client := strings.NewReplacer(":", "_", "[", "", "]", "").Replace(packet.ClientAddr)
+	return filepath.Join(dir, fmt.Sprintf("session-%d-%s", packet.SessionID, client))
+}
+
+// Writes data to name within the subdirectory of dir, creating it if needed.
+// Only the last element of name is used, since it comes off of the wire.
+func writeFile(dir, subdir, name string, data []byte) (string, error) {
+	dir = filepath.Join(dir, subdir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, filepath.Base(filepath.Clean("/"+name)))
+	return path, os.WriteFile(path, data, 0644)
+}
+
+// Converts a fixed size, NUL padded string field to a string.
+func cString(b []byte) string {
+	if i := strings.IndexByte(string(b), 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
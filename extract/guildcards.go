@@ -0,0 +1,207 @@
+package extract
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"log"
+	"strconv"
+
+	"github.com/dcrodman/archon/util"
+
+	"github.com/dcrodman/bb_reverse_proxy/proxy"
+)
+
+const (
+	loginSecurityType   uint16 = 0xE6
+	guildcardHeaderType uint16 = 0x01DC
+	guildcardChunkType  uint16 = 0x02DC
+)
+
+// Layout of the entries in the guild card file, which follow the blocked
+// senders list.
+const (
+	guildcardEntriesFrom = 0x114 + 0x1DE8 + 0x78
+	guildcardEntrySize   = 0x1BC
+	guildcardEntryCount  = 104
+)
+
+// Offset of the account's guild card number in the server's 0xE6 packet.
+const loginGuildcardOffset = 0x10
+
+var sectionIDNames = []string{
+	"Viridia", "Greenill", "Skyly", "Bluefull", "Purplenum",
+	"Pinkal", "Redria", "Oran", "Yellowboze", "Whitill",
+}
+
+var classNames = []string{
+	"HUmar", "HUnewearl", "HUcast", "RAmar", "RAcast", "RAcaseal",
+	"FOmarl", "FOnewm", "FOnewearl", "HUcaseal", "FOmar", "RAmarl",
+}
+
+type guildcardHeader struct {
+	Unknown  uint32
+	Length   uint32
+	Checksum uint32
+}
+
+type guildcardEntry struct {
+	Guildcard   uint32
+	Name        [48]byte
+	Team        [32]byte
+	Description [176]byte
+	Reserved    uint8
+	Language    uint8
+	SectionID   uint8
+	Class       uint8
+	Padding     uint32
+	Comment     [176]byte
+}
+
+// GuildcardEntry is one card in an account's guild card file.
+type GuildcardEntry struct {
+	Guildcard   uint32 `json:"guildcard"`
+	Name        string `json:"name"`
+	Team        string `json:"team"`
+	Description string `json:"description"`
+	SectionID   string `json:"section_id"`
+	Class       string `json:"class"`
+	Comment     string `json:"comment,omitempty"`
+}
+
+// The guild card file being sent to one session.
+type guildcardTransfer struct {
+	header guildcardHeader
+	file   *chunkedFile
+}
+
+// GuildcardSink reassembles the guild card file sent by the CHARACTER server in
+// 0x01DC and 0x02DC packets. The raw file and a JSON list of its entries are
+// written to a "guildcards" directory under each session's directory in Dir,
+// named after the guild card number of the account that logged in.
+type GuildcardSink struct {
+	Dir    string
+	Logger *log.Logger
+
+	accounts  map[uint64]uint32
+	transfers map[uint64]*guildcardTransfer
+}
+
+// NewGuildcardSink returns a GuildcardSink writing files under dir.
+func NewGuildcardSink(dir string, logger *log.Logger) *GuildcardSink {
+	return &GuildcardSink{
+		Dir:       dir,
+		Logger:    logger,
+		accounts:  make(map[uint64]uint32),
+		transfers: make(map[uint64]*guildcardTransfer),
+	}
+}
+
+// WritePacket collects any guild card header or chunk and writes out the file
+// once every chunk has been seen.
+func (sink *GuildcardSink) WritePacket(packet *proxy.PacketMsg) {
+	if packet.Err != nil {
+		return
+	}
+	var header bbHeader
+	util.StructFromBytes(packet.DecryptedData, &header)
+	body := packetBody(packet, header)
+
+	if packet.FromName != "Server" {
+		return
+	}
+
+	switch packet.Command {
+	case loginSecurityType:
+		if len(packet.DecryptedData) >= loginGuildcardOffset+4 {
+			sink.accounts[packet.SessionID] = binary.LittleEndian.Uint32(packet.DecryptedData[loginGuildcardOffset:])
+		}
+
+	case guildcardHeaderType:
+		transfer := &guildcardTransfer{file: newChunkedFile()}
+		util.StructFromBytes(body, &transfer.header)
+		if transfer.header.Length > maxFileSize {
+			sink.Logger.Printf("WARN: Ignoring %d byte guild card file; the limit is %d bytes\n",
+				transfer.header.Length, maxFileSize)
+			delete(sink.transfers, packet.SessionID)
+			return
+		}
+		sink.transfers[packet.SessionID] = transfer
+
+	case guildcardChunkType:
+		transfer := sink.transfers[packet.SessionID]
+		if transfer == nil || len(body) < 8 {
+			return
+		}
+		var chunk struct {
+			Unknown uint32
+			Chunk   uint32
+		}
+		util.StructFromBytes(body, &chunk)
+		transfer.file.add(chunk.Chunk, body[8:])
+		if data := transfer.file.assemble(transfer.header.Length); data != nil {
+			sink.writeFile(packet, transfer, data)
+			delete(sink.transfers, packet.SessionID)
+		}
+	}
+}
+
+func (sink *GuildcardSink) writeFile(packet *proxy.PacketMsg, transfer *guildcardTransfer, data []byte) {
+	if checksum := crc32.ChecksumIEEE(data); checksum != transfer.header.Checksum {
+		sink.Logger.Printf("WARN: Checksum mismatch for guild card file: header says %08x, data is %08x\n",
+			transfer.header.Checksum, checksum)
+	}
+	name := "unknown"
+	if account := sink.accounts[packet.SessionID]; account != 0 {
+		name = strconv.FormatUint(uint64(account), 10)
+	}
+	dir := SessionDir(sink.Dir, packet)
+
+	path, err := writeFile(dir, "guildcards", name+".bin", data)
+	if err != nil {
+		sink.Logger.Printf("Failed to write guild card file: %s\n", err.Error())
+		return
+	}
+	entries, err := json.MarshalIndent(decodeGuildcards(data), "", "  ")
+	if err == nil {
+		_, err = writeFile(dir, "guildcards", name+".json", append(entries, '\n'))
+	}
+	if err != nil {
+		sink.Logger.Printf("Failed to write guild card entries: %s\n", err.Error())
+		return
+	}
+	sink.Logger.Printf("Wrote %d byte guild card file %s\n", len(data), path)
+}
+
+// Returns the non-empty entries in a guild card file.
+func decodeGuildcards(data []byte) []GuildcardEntry {
+	entries := []GuildcardEntry{}
+	for i := 0; i < guildcardEntryCount; i++ {
+		offset := guildcardEntriesFrom + i*guildcardEntrySize
+		if offset+guildcardEntrySize > len(data) {
+			break
+		}
+		var raw guildcardEntry
+		util.StructFromBytes(data[offset:], &raw)
+		if raw.Guildcard == 0 {
+			continue
+		}
+		entries = append(entries, GuildcardEntry{
+			Guildcard:   raw.Guildcard,
+			Name:        proxy.DecodeText(raw.Name[:]),
+			Team:        proxy.DecodeText(raw.Team[:]),
+			Description: proxy.DecodeText(raw.Description[:]),
+			SectionID:   lookupName(sectionIDNames, raw.SectionID),
+			Class:       lookupName(classNames, raw.Class),
+			Comment:     proxy.DecodeText(raw.Comment[:]),
+		})
+	}
+	return entries
+}
+
+func lookupName(names []string, index uint8) string {
+	if int(index) < len(names) {
+		return names[index]
+	}
+	return "unknown"
+}
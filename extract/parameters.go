@@ -0,0 +1,127 @@
+package extract
+
+import (
+	"hash/crc32"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/dcrodman/archon/util"
+
+	"github.com/dcrodman/bb_reverse_proxy/proxy"
+)
+
+const (
+	parameterHeaderType uint16 = 0x01EB
+	parameterChunkType  uint16 = 0x02EB
+
+	parameterEntrySize = 0x4C
+)
+
+// One file described by the parameter header.
+type parameterEntry struct {
+	Size     uint32
+	Checksum uint32
+	Offset   uint32
+	Filename [0x40]byte
+}
+
+// The parameter files being sent to one session, which are concatenated and
+// sent as one chunked file.
+type parameterTransfer struct {
+	entries []parameterEntry
+	// Combined size of the files, which every entry is within.
+	size uint32
+	file *chunkedFile
+}
+
+// ParameterSink reassembles the parameter files (ItemPMT.prs, BattleParamEntry*.dat,
+// etc.) sent by the CHARACTER server in 0x01EB and 0x02EB packets and writes them
+// to a "params" directory under each session's directory in Dir. The PRS
+// compressed .prs files are also written decompressed to "params/decompressed".
+type ParameterSink struct {
+	Dir    string
+	Logger *log.Logger
+
+	transfers map[uint64]*parameterTransfer
+}
+
+// NewParameterSink returns a ParameterSink writing files under dir.
+func NewParameterSink(dir string, logger *log.Logger) *ParameterSink {
+	return &ParameterSink{Dir: dir, Logger: logger, transfers: make(map[uint64]*parameterTransfer)}
+}
+
+// WritePacket collects any parameter header or chunk and writes out the files
+// once every chunk has been seen.
+func (sink *ParameterSink) WritePacket(packet *proxy.PacketMsg) {
+	if packet.Err != nil || packet.FromName != "Server" {
+		return
+	}
+	var header bbHeader
+	util.StructFromBytes(packet.DecryptedData, &header)
+	body := packetBody(packet, header)
+
+	switch packet.Command {
+	case parameterHeaderType:
+		transfer := &parameterTransfer{file: newChunkedFile()}
+		for i := 0; i < int(header.Flags) && (i+1)*parameterEntrySize <= len(body); i++ {
+			var entry parameterEntry
+			util.StructFromBytes(body[i*parameterEntrySize:], &entry)
+			transfer.entries = append(transfer.entries, entry)
+		}
+		size, ok := totalSize(transfer.entries)
+		if !ok {
+			sink.Logger.Printf("WARN: Ignoring parameter header with files past %d bytes\n", maxFileSize)
+			delete(sink.transfers, packet.SessionID)
+			return
+		}
+		transfer.size = size
+		sink.transfers[packet.SessionID] = transfer
+
+	case parameterChunkType:
+		transfer := sink.transfers[packet.SessionID]
+		if transfer == nil || len(body) < 4 {
+			return
+		}
+		var chunk uint32
+		util.StructFromBytes(body, &chunk)
+		transfer.file.add(chunk, body[4:])
+		if data := transfer.file.assemble(transfer.size); data != nil {
+			sink.writeFiles(packet, transfer, data)
+			delete(sink.transfers, packet.SessionID)
+		}
+	}
+}
+
+// Returns the combined size of the files, or false if any of them ends past
+// maxFileSize. The sum is done in 64 bits so that entries can't wrap around.
+func totalSize(entries []parameterEntry) (uint32, bool) {
+	var total uint64
+	for _, entry := range entries {
+		if end := uint64(entry.Offset) + uint64(entry.Size); end > total {
+			total = end
+		}
+	}
+	return uint32(total), total <= maxFileSize
+}
+
+func (sink *ParameterSink) writeFiles(packet *proxy.PacketMsg, transfer *parameterTransfer, data []byte) {
+	dir := SessionDir(sink.Dir, packet)
+	for _, entry := range transfer.entries {
+		name := cString(entry.Filename[:])
+		file := data[entry.Offset : entry.Offset+entry.Size]
+		if checksum := crc32.ChecksumIEEE(file); checksum != entry.Checksum {
+			sink.Logger.Printf("WARN: Checksum mismatch for parameter file %s: header says %08x, data is %08x\n",
+				name, entry.Checksum, checksum)
+		}
+		path, err := writeFile(dir, "params", name, file)
+		if err != nil {
+			sink.Logger.Printf("Failed to write parameter file %s: %s\n", name, err.Error())
+			continue
+		}
+		sink.Logger.Printf("Wrote %d byte parameter file %s\n", len(file), path)
+		if strings.EqualFold(filepath.Ext(name), ".prs") {
+			writeDecompressed(sink.Logger, dir, "params", name, file)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package extract
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/dcrodman/archon/util"
+
+	"github.com/dcrodman/bb_reverse_proxy/proxy"
+	"github.com/dcrodman/bb_reverse_proxy/prs"
+	"github.com/dcrodman/bb_reverse_proxy/quest"
+)
+
+const (
+	questOpenType          uint16 = 0x44
+	questChunkType         uint16 = 0x13
+	downloadQuestOpenType  uint16 = 0xA6
+	downloadQuestChunkType uint16 = 0xA7
+
+	questChunkSize = 0x400
+)
+
+// Opens a quest file; the chunks that follow refer to it by filename.
+type questOpenFile struct {
+	Unused   [0x22]byte
+	Type     uint16
+	Filename [0x10]byte
+	FileSize uint32
+	Name     [0x18]byte
+}
+
+// One chunk of a quest file. The chunk's index is in the header's flags.
+type questFileChunk struct {
+	Filename [0x10]byte
+	Data     [questChunkSize]byte
+	DataSize uint32
+}
+
+// A quest file being received, which may be interleaved with other files.
+type questFile struct {
+	name     string
+	data     []byte
+	chunks   map[uint32]bool
+	received int
+}
+
+// The quest files being received on one session, by filename.
+type questFiles map[string]*questFile
+
+// Adds an open or chunk packet to the files being received and returns the
+// file it completed, if any. Files opened with a size past maxFileSize are
+// ignored with an error.
+func (files questFiles) add(command uint16, header bbHeader, body []byte) (*questFile, error) {
+	switch command {
+	case questOpenType, downloadQuestOpenType:
+		var open questOpenFile
+		util.StructFromBytes(body, &open)
+		name := cString(open.Filename[:])
+		delete(files, name)
+		if open.FileSize > maxFileSize {
+			return nil, fmt.Errorf("quest file %s claims to be %d bytes; the limit is %d", name, open.FileSize, maxFileSize)
+		}
+		file := &questFile{name: name, data: make([]byte, open.FileSize), chunks: make(map[uint32]bool)}
+		// No chunks follow an empty file, so it's already complete.
+		if open.FileSize == 0 {
+			return file, nil
+		}
+		files[name] = file
+
+	case questChunkType, downloadQuestChunkType:
+		var chunk questFileChunk
+		util.StructFromBytes(body, &chunk)
+		file := files[cString(chunk.Filename[:])]
+		if file == nil || file.chunks[header.Flags] || chunk.DataSize > questChunkSize {
+			return nil, nil
+		}
+		offset := int(header.Flags) * questChunkSize
+		if offset >= len(file.data) {
+			return nil, nil
+		}
+		file.chunks[header.Flags] = true
+		file.received += copy(file.data[offset:], chunk.Data[:chunk.DataSize])
+		if file.received >= len(file.data) {
+			delete(files, file.name)
+			return file, nil
+		}
+	}
+	return nil, nil
+}
+
+// QuestSink reassembles the quest files sent by the SHIP server, either when a
+// quest is loaded (0x44 and 0x13) or downloaded (0xA6 and 0xA7). Each file is
+// written as received to a "quests" directory under the session's directory in
+// Dir, with the PRS compressed .bin and .dat files also written decompressed to
+// "quests/decompressed" and the scripts in the .bin files disassembled to
+// "quests/disassembled". The .bin and .dat files packed in a .qst file are
+// extracted from it in the same way.
+type QuestSink struct {
+	Dir    string
+	Logger *log.Logger
+
+	sessions map[uint64]questFiles
+}
+
+// NewQuestSink returns a QuestSink writing files under dir.
+func NewQuestSink(dir string, logger *log.Logger) *QuestSink {
+	return &QuestSink{Dir: dir, Logger: logger, sessions: make(map[uint64]questFiles)}
+}
+
+// WritePacket collects any quest file packets and writes out each file once
+// all of its chunks have been seen.
+func (sink *QuestSink) WritePacket(packet *proxy.PacketMsg) {
+	if packet.Err != nil || packet.FromName != "Server" {
+		return
+	}
+	switch packet.Command {
+	case questOpenType, questChunkType, downloadQuestOpenType, downloadQuestChunkType:
+	default:
+		return
+	}
+	var header bbHeader
+	util.StructFromBytes(packet.DecryptedData, &header)
+
+	files := sink.sessions[packet.SessionID]
+	if files == nil {
+		files = make(questFiles)
+		sink.sessions[packet.SessionID] = files
+	}
+	file, err := files.add(packet.Command, header, packetBody(packet, header))
+	if err != nil {
+		sink.Logger.Printf("WARN: Ignoring %s\n", err.Error())
+	}
+	if file != nil {
+		sink.writeFile(SessionDir(sink.Dir, packet), file)
+	}
+}
+
+func (sink *QuestSink) writeFile(dir string, file *questFile) {
+	path, err := writeFile(dir, "quests", file.name, file.data)
+	if err != nil {
+		sink.Logger.Printf("Failed to write quest file %s: %s\n", file.name, err.Error())
+		return
+	}
+	sink.Logger.Printf("Wrote %d byte quest file %s\n", len(file.data), path)
+
+	switch strings.ToLower(filepath.Ext(file.name)) {
+	case ".bin":
+		bin := writeDecompressed(sink.Logger, dir, "quests", file.name, file.data)
+		if bin == nil {
+			return
+		}
+		listing, err := quest.Disassemble(bin)
+		if err == nil {
+			_, err = writeFile(dir, filepath.Join("quests", "disassembled"), file.name+".txt", []byte(listing))
+		}
+		if err != nil {
+			sink.Logger.Printf("Unable to disassemble %s: %s\n", file.name, err.Error())
+		}
+	case ".dat":
+		writeDecompressed(sink.Logger, dir, "quests", file.name, file.data)
+	case ".qst":
+		for _, packed := range unpackQst(file.data) {
+			sink.writeFile(dir, packed)
+		}
+	}
+}
+
+// Returns the files in a .qst file, which holds the same open and chunk
+// packets that the server sends for the quest.
+func unpackQst(data []byte) []*questFile {
+	var completed []*questFile
+	files := make(questFiles)
+	for len(data) >= bbHeaderSize {
+		var header bbHeader
+		util.StructFromBytes(data, &header)
+		size := int(header.Size)
+		if size < bbHeaderSize || size > len(data) {
+			break
+		}
+		// Files with implausible sizes are skipped, leaving the rest to be unpacked.
+		if file, _ := files.add(header.Type, header, data[bbHeaderSize:size]); file != nil {
+			completed = append(completed, file)
+		}
+		data = data[size:]
+	}
+	return completed
+}
+
+// Writes the PRS decompressed version of a file to the "decompressed"
+// directory within subdir, returning the decompressed data if successful.
+func writeDecompressed(logger *log.Logger, dir, subdir, name string, data []byte) []byte {
+	decompressed, err := prs.DecompressLimit(data, maxFileSize)
+	if err != nil {
+		logger.Printf("Unable to decompress %s: %s\n", name, err.Error())
+		return nil
+	}
+	if _, err := writeFile(dir, filepath.Join(subdir, "decompressed"), name, decompressed); err != nil {
+		logger.Printf("Failed to write decompressed %s: %s\n", name, err.Error())
+	}
+	return decompressed
+}
@@ -0,0 +1,163 @@
+package output
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dcrodman/bb_reverse_proxy/proxy"
+)
+
+const (
+	manifestName = "manifest.jsonl"
+	// Session files that haven't been written to for this long are closed, and
+	// reopened if the session turns out to still be going.
+	idleTimeout = time.Minute
+	// Offset of the account's guild card number in the server's 0xE6 packet.
+	loginGuildcardOffset = 0x10
+)
+
+// A line in the manifest.
+type manifestEntry struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Command   []string  `json:"command,omitempty"`
+	Session   uint64    `json:"session,omitempty"`
+	Server    string    `json:"server,omitempty"`
+	Client    string    `json:"client,omitempty"`
+	File      string    `json:"file,omitempty"`
+	Guildcard uint32    `json:"guildcard,omitempty"`
+}
+
+type sessionFile struct {
+	file      *RotatingFile
+	path      string
+	lastWrite time.Time
+	guildcard uint32
+}
+
+// SessionSink writes the packets of each session to a file of their own under
+// Dir. Files are grouped into a directory per client IP address, so that the
+// LOGIN, CHARACTER, SHIP and BLOCK connections of one player end up together,
+// and are named after the time the session started, the client's port and the
+// server:
+//
+//	<dir>/<client ip>/<time>_<client port>_<server>.log
+//
+// A manifest.jsonl in Dir records each run, the file of every session and the
+// guild card number of the account that logged in on it.
+type SessionSink struct {
+	Dir       string
+	Logger    *log.Logger
+	NamesOnly bool
+	// Limits passed on to the RotatingFile of each session.
+	MaxSize int64
+	MaxAge  time.Duration
+
+	manifest *os.File
+	sessions map[uint64]*sessionFile
+	lastIdle time.Time
+}
+
+// NewSessionSink creates dir if needed and records the start of the run in its
+// manifest. Problems writing the files are reported to logger.
+func NewSessionSink(dir string, logger *log.Logger) (*SessionSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	manifest, err := os.OpenFile(filepath.Join(dir, manifestName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	sink := &SessionSink{
+		Dir:      dir,
+		Logger:   logger,
+		manifest: manifest,
+		sessions: make(map[uint64]*sessionFile),
+	}
+	sink.record(manifestEntry{Type: "run", Time: time.Now(), Command: os.Args})
+	return sink, nil
+}
+
+// WritePacket appends the packet to its session's file.
+func (sink *SessionSink) WritePacket(packet *proxy.PacketMsg) {
+	session, err := sink.session(packet)
+	if err != nil {
+		sink.Logger.Printf("Unable to open session file: %s\n", err.Error())
+		return
+	}
+	header := fmt.Sprintf("%s %s %s packet\n", packet.Timestamp.Format("15:04:05.000"), packet.Server, packet.FromName)
+	if _, err := session.file.Write([]byte(proxy.FormatPayload(packet, header, sink.NamesOnly) + "\n")); err != nil {
+		sink.Logger.Printf("Unable to write to %s: %s\n", session.path, err.Error())
+	}
+	session.lastWrite = time.Now()
+
+	if packet.Command == 0xE6 && packet.FromName == "Server" && session.guildcard == 0 &&
+		len(packet.DecryptedData) >= loginGuildcardOffset+4 {
+		session.guildcard = binary.LittleEndian.Uint32(packet.DecryptedData[loginGuildcardOffset:])
+		sink.record(manifestEntry{Type: "player", Time: packet.Timestamp, Session: packet.SessionID,
+			Guildcard: session.guildcard})
+	}
+	sink.closeIdle()
+}
+
+// Returns the packet's session, opening its file if needed.
+func (sink *SessionSink) session(packet *proxy.PacketMsg) (*sessionFile, error) {
+	session := sink.sessions[packet.SessionID]
+	if session == nil {
+		host, port, err := net.SplitHostPort(packet.ClientAddr)
+		if err != nil {
+			host, port = packet.ClientAddr, "0"
+		}
+		host = strings.ReplaceAll(host, ":", "_")
+		name := fmt.Sprintf("%s_%s_%s.log", packet.Timestamp.Format(fileTimeFormat), port, packet.Server)
+		session = &sessionFile{path: filepath.Join(host, name)}
+		sink.sessions[packet.SessionID] = session
+		sink.record(manifestEntry{Type: "session", Time: packet.Timestamp, Session: packet.SessionID,
+			Server: packet.Server, Client: packet.ClientAddr, File: session.path})
+	}
+	if session.file == nil {
+		path := filepath.Join(sink.Dir, session.path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		file, err := OpenRotatingFile(path, sink.MaxSize, sink.MaxAge)
+		if err != nil {
+			return nil, err
+		}
+		session.file = file
+	}
+	return session, nil
+}
+
+// Closes the files of sessions that have gone quiet, checking at most once per
+// idle period.
+func (sink *SessionSink) closeIdle() {
+	now := time.Now()
+	if now.Sub(sink.lastIdle) < idleTimeout {
+		return
+	}
+	sink.lastIdle = now
+	for _, session := range sink.sessions {
+		if session.file != nil && now.Sub(session.lastWrite) > idleTimeout {
+			session.file.Close()
+			session.file = nil
+		}
+	}
+}
+
+func (sink *SessionSink) record(entry manifestEntry) {
+	line, err := json.Marshal(entry)
+	if err == nil {
+		_, err = sink.manifest.Write(append(line, '\n'))
+	}
+	if err != nil {
+		sink.Logger.Printf("Unable to write to manifest: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// splitHostPort breaks a host:port address into its parts, validating the port.
+// IPv6 literals must be enclosed in brackets, e.g. "[::1]:12000".
+func splitHostPort(addr string) (string, uint16, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid address %q: %s", addr, err.Error())
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return "", 0, fmt.Errorf("invalid port in address %q", addr)
+	}
+	return host, uint16(port), nil
+}
+
+// resolveTCPAddr validates addr and resolves any hostname in it.
+func resolveTCPAddr(addr string) (*net.TCPAddr, error) {
+	if _, _, err := splitHostPort(addr); err != nil {
+		return nil, err
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve %q: %s", addr, err.Error())
+	}
+	return tcpAddr, nil
+}
+
+// resolveRedirectIP resolves host to the IPv4 address clients will be sent to in
+// redirect packets. The BB redirect packet only has room for four bytes, so IPv6
+// and unspecified (wildcard) addresses cannot be advertised.
+func resolveRedirectIP(host string) ([4]byte, error) {
+	var converted [4]byte
+	if host == "" {
+		return converted, fmt.Errorf("no address to advertise in redirect packets")
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		var err error
+		if ips, err = net.LookupIP(host); err != nil {
+			return converted, fmt.Errorf("unable to resolve advertised host %q: %s", host, err.Error())
+		}
+	}
+
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			if ip4.IsUnspecified() {
+				return converted, fmt.Errorf(
+					"cannot advertise unspecified address %s in redirects; set an advertised address", host)
+			}
+			copy(converted[:], ip4)
+			return converted, nil
+		}
+	}
+	return converted, fmt.Errorf(
+		"advertised host %q has no IPv4 address; BB redirect packets only support IPv4", host)
+}
+
+// SubnetAddress advertises Host in redirects sent to clients connecting from
+// Subnet, e.g. so that LAN clients are sent a private address while remote
+// clients get the public one.
+type SubnetAddress struct {
+	// Client network in CIDR notation, e.g. "192.168.0.0/16".
+	Subnet string
+	Host   string
+}
+
+// A resolved address to inject into redirect packets.
+type advertisedAddr struct {
+	subnet *net.IPNet
+	host   string
+	ip     [4]byte
+}
+
+func resolveAdvertisedAddr(host string) (advertisedAddr, error) {
+	ip, err := resolveRedirectIP(host)
+	return advertisedAddr{host: host, ip: ip}, err
+}
+
+func resolveSubnetAddresses(entries []SubnetAddress) ([]advertisedAddr, error) {
+	var addrs []advertisedAddr
+	for _, entry := range entries {
+		_, subnet, err := net.ParseCIDR(entry.Subnet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid advertised subnet %q: %s", entry.Subnet, err.Error())
+		}
+		addr, err := resolveAdvertisedAddr(entry.Host)
+		if err != nil {
+			return nil, err
+		}
+		addr.subnet = subnet
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// Returns the IP of a TCP or UDP address, or nil for any other kind.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
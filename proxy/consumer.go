@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+const displayWidth = 16
+
+// Sink receives every packet intercepted by a Server, in the order in which they
+// are forwarded. Sinks are only ever called from a single goroutine.
+type Sink interface {
+	WritePacket(packet *PacketMsg)
+}
+
+// LogSink writes a hex dump of each packet to a logger.
+type LogSink struct {
+	Logger *log.Logger
+	// Only print packet names instead of the full data.
+	NamesOnly bool
+}
+
+// NewLogSink returns a Sink that dumps packets to logger.
+func NewLogSink(logger *log.Logger, namesOnly bool) *LogSink {
+	return &LogSink{Logger: logger, NamesOnly: namesOnly}
+}
+
+// WritePacket logs the packet's name and, unless NamesOnly is set, its contents.
+func (sink *LogSink) WritePacket(packet *PacketMsg) {
+	sink.Logger.Println(FormatPayload(packet, fmt.Sprintf(
+		"%s %s packet\n", packet.Server, packet.FromName), sink.NamesOnly))
+}
+
+// Handler for any packets intercepted by the proxy. Responsible for sending the packets to
+// their intended destination as well as doing any logging we care about.
+func (s *Server) consumePackets() {
+	// Once stopped, keep going until the sessions that were left open are over.
+	finished := make(chan struct{})
+	go func() {
+		<-s.done
+		s.openSessions.Wait()
+		close(finished)
+	}()
+	for {
+		select {
+		case packet := <-s.packetChan:
+			s.consumePacket(packet)
+		case <-finished:
+			return
+		}
+	}
+}
+
+func (s *Server) consumePacket(packet *PacketMsg) {
+	redacted := s.redactor.Redact(packet)
+	for _, sink := range s.sinks {
+		sink.WritePacket(redacted)
+	}
+	if packet.sendFunc != nil {
+		packet.sendFunc()
+	}
+}
+
+// FormatPayload renders a packet as a header line, the packet name and a hex dump
+// of the decrypted contents.
+func FormatPayload(packet *PacketMsg, headerStr string, namesOnly bool) string {
+	var logBuf bytes.Buffer
+	logBuf.WriteString(headerStr)
+
+	name := PacketName(packet.Server, packet.Command)
+	if packet.Err != nil {
+		logBuf.WriteString(fmt.Sprintf("Error: %s\n", packet.Err.Error()))
+	} else if name == "" {
+		logBuf.WriteString(fmt.Sprintf("Unknown packet %02x\n", packet.Command))
+	} else {
+		logBuf.WriteString(name + "\n")
+	}
+	if msg := DecodeChat(packet); msg != nil {
+		logBuf.WriteString(fmt.Sprintf("Text: %s\n", msg))
+	}
+
+	if namesOnly {
+		return logBuf.String()
+	}
+
+	pktLen := int(packet.Size)
+	data := packet.DecryptedData
+	for rem, offset := pktLen, 0; rem > 0; rem -= displayWidth {
+		if rem < displayWidth {
+			appendPacketLine(&logBuf, data[(pktLen-rem):pktLen], rem, offset)
+		} else {
+			appendPacketLine(&logBuf, data[offset:offset+displayWidth], displayWidth, offset)
+		}
+		offset += displayWidth
+	}
+	return logBuf.String()
+}
+
+func appendPacketLine(logBuf *bytes.Buffer, data []uint8, length int, offset int) {
+	logBuf.WriteString(fmt.Sprintf("(%04X) ", offset))
+	// Print our bytes.
+	for i, j := 0, 0; i < length; i++ {
+		if j == 8 {
+			// Visual aid - spacing between groups of 8 bytes.
+			j = 0
+			logBuf.WriteString("  ")
+		}
+		logBuf.WriteString(fmt.Sprintf("%02x ", data[i]))
+		j++
+	}
+	// Fill in the gap if we don't have enough bytes to fill the line.
+	for i := length; i < displayWidth; i++ {
+		if i == 8 {
+			logBuf.WriteString("  ")
+		}
+		logBuf.WriteString("   ")
+	}
+	logBuf.WriteString("    ")
+	// Display the print characters as-is, others as periods.
+	for i := 0; i < length; i++ {
+		c := data[i]
+		if strconv.IsPrint(rune(c)) {
+			logBuf.WriteString(fmt.Sprintf("%c", data[i]))
+		} else {
+			logBuf.WriteString(".")
+		}
+	}
+	logBuf.WriteString("\n")
+}
@@ -0,0 +1,270 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// ControlHandler returns an http.Handler for changing the Server's behavior while
+// it runs. Responses are JSON.
+//
+//	GET  /impairments  lists the impairment of every proxy and direction
+//	POST /impairments  sets the impairment given by the "impairment" form value in
+//	                   ParseImpairment's format; the "server" and "direction"
+//	                   values pick which to change and default to all of them
+//
+//	GET    /breakpoints  lists the breakpoints
+//	POST   /breakpoints  adds the breakpoint given by the "breakpoint" form value
+//	                     in ParseBreakpoint's format
+//	DELETE /breakpoints  removes the breakpoint with the given "id"
+//
+//	GET  /paused         lists the packets paused at breakpoints, decoded and
+//	                     with sensitive fields redacted
+//	POST /paused/resume  resumes the paused packet with the given "id" using the
+//	                     "action" release (the default), step or drop. A hex
+//	                     "data" value is written over the packet at "offset"
+//	                     first, and "size" truncates or pads it
+//
+//	GET /shadow  reports how the shadow servers' responses differ from the
+//	             primary servers', by command and byte range
+//
+//	GET /upstreams  lists each proxy's servers with whether they're healthy and
+//	                how many sessions they have
+func (s *Server) ControlHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/impairments", s.handleImpairments)
+	mux.HandleFunc("/breakpoints", s.handleBreakpoints)
+	mux.HandleFunc("/paused", s.handlePaused)
+	mux.HandleFunc("/paused/resume", s.handleResume)
+	mux.HandleFunc("/shadow", s.handleShadow)
+	mux.HandleFunc("/upstreams", s.handleUpstreams)
+	return mux
+}
+
+type impairmentJSON struct {
+	Server     string `json:"server"`
+	Direction  string `json:"direction"`
+	Impairment string `json:"impairment"`
+}
+
+func (s *Server) handleImpairments(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		imp, err := ParseImpairment(r.FormValue("impairment"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.SetImpairment(r.FormValue("server"), r.FormValue("direction"), imp); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.logger.Printf("Set %s impairment for %s %s packets\n",
+			imp, orAll(r.FormValue("server")), orAll(r.FormValue("direction")))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	statuses := []impairmentJSON{}
+	for _, status := range s.Impairments() {
+		statuses = append(statuses, impairmentJSON{
+			Server:     status.Server,
+			Direction:  status.Direction,
+			Impairment: status.Impairment.String(),
+		})
+	}
+	writeJSON(w, statuses)
+}
+
+type breakpointJSON struct {
+	ID         int    `json:"id"`
+	Breakpoint string `json:"breakpoint"`
+}
+
+func (s *Server) handleBreakpoints(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		bp, err := ParseBreakpoint(r.FormValue("breakpoint"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id := s.AddBreakpoint(bp)
+		s.logger.Printf("Added breakpoint %d: %s\n", id, bp)
+	case http.MethodDelete:
+		id, err := strconv.Atoi(r.FormValue("id"))
+		if err == nil {
+			err = s.RemoveBreakpoint(id)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.logger.Printf("Removed breakpoint %d\n", id)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	breakpoints := []breakpointJSON{}
+	for _, bp := range s.Breakpoints() {
+		breakpoints = append(breakpoints, breakpointJSON{ID: bp.ID, Breakpoint: bp.String()})
+	}
+	writeJSON(w, breakpoints)
+}
+
+type pausedJSON struct {
+	ID         int    `json:"id"`
+	Breakpoint int    `json:"breakpoint,omitempty"`
+	Session    uint64 `json:"session"`
+	Server     string `json:"server"`
+	Direction  string `json:"direction"`
+	Decoded    string `json:"decoded"`
+}
+
+func (s *Server) handlePaused(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.writePaused(w)
+}
+
+func (s *Server) writePaused(w http.ResponseWriter) {
+	paused := []pausedJSON{}
+	for _, p := range s.PausedPackets() {
+		paused = append(paused, pausedJSON{
+			ID:         p.ID,
+			Breakpoint: p.Breakpoint,
+			Session:    p.Packet.SessionID,
+			Server:     p.Packet.Server,
+			Direction:  p.Packet.FromName,
+			Decoded:    FormatPayload(p.Packet, "", false),
+		})
+	}
+	writeJSON(w, paused)
+}
+
+func (s *Server) handleResume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	action, err := ParseResumeAction(r.FormValue("action"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var edits []PacketEdit
+	if r.FormValue("data") != "" || r.FormValue("size") != "" {
+		var edit PacketEdit
+		if edit.Data, err = hex.DecodeString(r.FormValue("data")); err != nil {
+			http.Error(w, "invalid data: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if edit.Offset, err = formInt(r, "offset"); err != nil {
+			http.Error(w, "invalid offset: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if edit.Size, err = formInt(r, "size"); err != nil {
+			http.Error(w, "invalid size: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		edits = append(edits, edit)
+	}
+	if err := s.ResumePacket(id, action, edits...); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.writePaused(w)
+}
+
+type shadowDiffJSON struct {
+	Server         string         `json:"server"`
+	Command        string         `json:"command"`
+	Compared       int            `json:"compared"`
+	Differing      int            `json:"differing"`
+	SizeMismatches int            `json:"size_mismatches"`
+	Missing        int            `json:"missing"`
+	Extra          int            `json:"extra"`
+	Fields         map[string]int `json:"fields,omitempty"`
+}
+
+func (s *Server) handleShadow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	diffs := []shadowDiffJSON{}
+	for _, diff := range s.ShadowReport() {
+		diffs = append(diffs, shadowDiffJSON{
+			Server:         diff.Server,
+			Command:        commandName(diff.Server, diff.Command),
+			Compared:       diff.Compared,
+			Differing:      diff.Differing,
+			SizeMismatches: diff.SizeMismatches,
+			Missing:        diff.Missing,
+			Extra:          diff.Extra,
+			Fields:         diff.Fields,
+		})
+	}
+	writeJSON(w, diffs)
+}
+
+type upstreamJSON struct {
+	Server   string `json:"server"`
+	Host     string `json:"host"`
+	Healthy  bool   `json:"healthy"`
+	Sessions int    `json:"sessions"`
+}
+
+func (s *Server) handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	upstreams := []upstreamJSON{}
+	for _, u := range s.Upstreams() {
+		upstreams = append(upstreams, upstreamJSON{
+			Server:   u.Server,
+			Host:     u.Host,
+			Healthy:  u.Healthy,
+			Sessions: u.Sessions,
+		})
+	}
+	writeJSON(w, upstreams)
+}
+
+// Reads an optional number, which may be decimal or prefixed with 0x.
+func formInt(r *http.Request, name string) (int, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(value, 0, 32)
+	return int(n), err
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func orAll(name string) string {
+	if name == "" {
+		return "all"
+	}
+	return name
+}
@@ -0,0 +1,386 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Breakpoint pauses the packets that match it before they're handed to the sinks
+// and forwarded, holding up the rest of the session in that direction until the
+// packet is resumed with ResumePacket. Empty and nil fields match anything.
+type Breakpoint struct {
+	ID        int
+	Server    string
+	Direction string
+	Command   *uint16
+	// The first byte of the body, which selects the action carried by game
+	// packets such as 0x60 and 0x62.
+	Subcommand *byte
+	// Matched anywhere in the decrypted packet.
+	Pattern []byte
+}
+
+// ParseBreakpoint reads a Breakpoint from a comma separated list of conditions
+// such as "server=BLOCK1,direction=Client,command=0x60,subcommand=0x3E,pattern=0a0b".
+// Numbers may be decimal or prefixed with 0x and patterns are hex.
+func ParseBreakpoint(spec string) (Breakpoint, error) {
+	var bp Breakpoint
+	if spec == "" {
+		return bp, fmt.Errorf("breakpoint needs at least one condition")
+	}
+	for _, condition := range strings.Split(spec, ",") {
+		parts := strings.SplitN(condition, "=", 2)
+		if len(parts) != 2 {
+			return bp, fmt.Errorf("expected name=value, got %q", condition)
+		}
+		name, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		switch name {
+		case "server":
+			bp.Server = value
+		case "direction":
+			if value != "Client" && value != "Server" {
+				return bp, fmt.Errorf("unknown direction %q", value)
+			}
+			bp.Direction = value
+		case "command":
+			n, err := strconv.ParseUint(value, 0, 16)
+			if err != nil {
+				return bp, fmt.Errorf("invalid command: %s", err.Error())
+			}
+			command := uint16(n)
+			bp.Command = &command
+		case "subcommand":
+			n, err := strconv.ParseUint(value, 0, 8)
+			if err != nil {
+				return bp, fmt.Errorf("invalid subcommand: %s", err.Error())
+			}
+			subcommand := byte(n)
+			bp.Subcommand = &subcommand
+		case "pattern":
+			pattern, err := hex.DecodeString(value)
+			if err != nil || len(pattern) == 0 {
+				return bp, fmt.Errorf("invalid pattern %q", value)
+			}
+			bp.Pattern = pattern
+		default:
+			return bp, fmt.Errorf("unknown breakpoint condition %q", name)
+		}
+	}
+	return bp, nil
+}
+
+// String returns the breakpoint's conditions in the format accepted by
+// ParseBreakpoint.
+func (bp Breakpoint) String() string {
+	var conditions []string
+	if bp.Server != "" {
+		conditions = append(conditions, "server="+bp.Server)
+	}
+	if bp.Direction != "" {
+		conditions = append(conditions, "direction="+bp.Direction)
+	}
+	if bp.Command != nil {
+		conditions = append(conditions, fmt.Sprintf("command=0x%02X", *bp.Command))
+	}
+	if bp.Subcommand != nil {
+		conditions = append(conditions, fmt.Sprintf("subcommand=0x%02X", *bp.Subcommand))
+	}
+	if len(bp.Pattern) > 0 {
+		conditions = append(conditions, "pattern="+hex.EncodeToString(bp.Pattern))
+	}
+	return strings.Join(conditions, ",")
+}
+
+func (bp Breakpoint) matches(packet *PacketMsg) bool {
+	if bp.Server != "" && bp.Server != packet.Server {
+		return false
+	}
+	if bp.Direction != "" && bp.Direction != packet.FromName {
+		return false
+	}
+	if bp.Command != nil && *bp.Command != packet.Command {
+		return false
+	}
+	if bp.Subcommand != nil {
+		headerSize := int(packet.Protocol.headerSize())
+		if len(packet.DecryptedData) <= headerSize || packet.DecryptedData[headerSize] != *bp.Subcommand {
+			return false
+		}
+	}
+	return len(bp.Pattern) == 0 || bytes.Contains(packet.DecryptedData, bp.Pattern)
+}
+
+// ResumeAction is what to do with a paused packet.
+type ResumeAction int
+
+const (
+	// Release sends the packet on its way.
+	Release ResumeAction = iota
+	// Step releases the packet and pauses the next one in the same session and
+	// direction, whether or not it hits a breakpoint.
+	Step
+	// Drop discards the packet without it reaching the sinks or its destination.
+	Drop
+)
+
+// ParseResumeAction returns the action named "release", "step" or "drop".
+func ParseResumeAction(name string) (ResumeAction, error) {
+	switch name {
+	case "release", "":
+		return Release, nil
+	case "step":
+		return Step, nil
+	case "drop":
+		return Drop, nil
+	}
+	return Release, fmt.Errorf("unknown action %q", name)
+}
+
+// PacketEdit describes a change to a paused packet's decrypted contents.
+type PacketEdit struct {
+	// Bytes to write over the packet starting at Offset, growing it if needed.
+	Offset int
+	Data   []byte
+	// New length of the packet, truncating or padding it with zeros; 0 leaves the
+	// length alone. The size in the header is not updated automatically.
+	Size int
+}
+
+// Returns a copy of data with the edit applied.
+func (edit PacketEdit) apply(data []byte) []byte {
+	edited := append([]byte(nil), data...)
+	if end := edit.Offset + len(edit.Data); end > len(edited) {
+		edited = append(edited, make([]byte, end-len(edited))...)
+	}
+	copy(edited[edit.Offset:], edit.Data)
+	if edit.Size > 0 {
+		if edit.Size < len(edited) {
+			edited = edited[:edit.Size]
+		} else {
+			edited = append(edited, make([]byte, edit.Size-len(edited))...)
+		}
+	}
+	return edited
+}
+
+// PausedPacket is a packet held at a breakpoint.
+type PausedPacket struct {
+	ID int
+	// Breakpoint that the packet hit, or 0 if it was paused after a step.
+	Breakpoint int
+	// A copy of the packet with any sensitive fields redacted.
+	Packet *PacketMsg
+}
+
+type pausedPacket struct {
+	PausedPacket
+	packet *PacketMsg
+	// Replaces the contents of the packet, or says why they can't be.
+	edit func(data []byte) error
+	// Says why the packet can't be dropped, if it can't.
+	canDrop func() error
+	resume  chan ResumeAction
+}
+
+// Identifies one direction of a session.
+type debugKey struct {
+	sessionID uint64
+	direction string
+}
+
+// Holds the breakpoints of a Server and the packets paused at them.
+type debugger struct {
+	mu             sync.Mutex
+	breakpoints    []Breakpoint
+	nextBreakpoint int
+	paused         map[int]*pausedPacket
+	nextPaused     int
+	// Session directions whose next packet is to be paused.
+	stepping map[debugKey]bool
+}
+
+func newDebugger() *debugger {
+	return &debugger{
+		paused:   make(map[int]*pausedPacket),
+		stepping: make(map[debugKey]bool),
+	}
+}
+
+// Returns the breakpoint that the packet stops at, 0 if it was stepped to, or
+// false if it should go through.
+func (d *debugger) breakpointFor(packet *PacketMsg) (int, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := debugKey{packet.SessionID, packet.FromName}
+	if d.stepping[key] {
+		delete(d.stepping, key)
+		return 0, true
+	}
+	for _, bp := range d.breakpoints {
+		if bp.matches(packet) {
+			return bp.ID, true
+		}
+	}
+	return 0, false
+}
+
+// Pauses the packet if it hits a breakpoint and waits for it to be resumed,
+// returning false if it was dropped. Gives up on the packet if stopped reports
+// that its session has ended.
+func (i *Interceptor) pauseAtBreakpoint(packet *PacketMsg) bool {
+	s := i.server
+	d := s.debugger
+	breakpoint, hit := d.breakpointFor(packet)
+	if !hit {
+		return true
+	}
+
+	d.mu.Lock()
+	d.nextPaused++
+	p := &pausedPacket{
+		PausedPacket: PausedPacket{ID: d.nextPaused, Breakpoint: breakpoint},
+		packet:       packet,
+		edit:         func(data []byte) error { return i.editPacket(packet, data) },
+		canDrop:      i.canDrop,
+		resume:       make(chan ResumeAction, 1),
+	}
+	d.paused[p.ID] = p
+	d.mu.Unlock()
+
+	if breakpoint == 0 {
+		s.logger.Printf("Stepped to packet %d\n", p.ID)
+	} else {
+		s.logger.Printf("Paused packet %d at breakpoint %d\n", p.ID, breakpoint)
+	}
+	s.logger.Println(FormatPayload(s.redactor.Redact(packet), fmt.Sprintf(
+		"%s %s packet (session %d)\n", packet.Server, packet.FromName, packet.SessionID), false))
+
+	for {
+		select {
+		case action := <-p.resume:
+			return i.resumed(packet, action)
+		case <-time.After(time.Second):
+		}
+		// Same as when reading, check every so often whether the session is over.
+		if i.stopped() {
+			d.mu.Lock()
+			_, waiting := d.paused[p.ID]
+			delete(d.paused, p.ID)
+			d.mu.Unlock()
+			if waiting {
+				return false
+			}
+		}
+	}
+}
+
+func (i *Interceptor) resumed(packet *PacketMsg, action ResumeAction) bool {
+	if action == Step {
+		d := i.server.debugger
+		d.mu.Lock()
+		d.stepping[debugKey{packet.SessionID, packet.FromName}] = true
+		d.mu.Unlock()
+	}
+	return action != Drop
+}
+
+// Breakpoints returns the Server's breakpoints in the order they were added.
+func (s *Server) Breakpoints() []Breakpoint {
+	s.debugger.mu.Lock()
+	defer s.debugger.mu.Unlock()
+	return append([]Breakpoint(nil), s.debugger.breakpoints...)
+}
+
+// AddBreakpoint starts pausing the packets that match bp, returning the ID
+// assigned to it.
+func (s *Server) AddBreakpoint(bp Breakpoint) int {
+	d := s.debugger
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.nextBreakpoint++
+	bp.ID = d.nextBreakpoint
+	d.breakpoints = append(d.breakpoints, bp)
+	return bp.ID
+}
+
+// RemoveBreakpoint deletes a breakpoint. Packets already paused at it stay
+// paused until they're resumed.
+func (s *Server) RemoveBreakpoint(id int) error {
+	d := s.debugger
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for n, bp := range d.breakpoints {
+		if bp.ID == id {
+			d.breakpoints = append(d.breakpoints[:n], d.breakpoints[n+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no breakpoint %d", id)
+}
+
+// PausedPackets returns the packets currently held at breakpoints, oldest first.
+func (s *Server) PausedPackets() []PausedPacket {
+	d := s.debugger
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var paused []PausedPacket
+	for _, p := range d.paused {
+		copied := *p.packet
+		copied.DecryptedData = append([]byte(nil), p.packet.DecryptedData...)
+		copied.Data = append([]byte(nil), p.packet.Data...)
+		paused = append(paused, PausedPacket{
+			ID:         p.ID,
+			Breakpoint: p.Breakpoint,
+			Packet:     s.redactor.Redact(&copied),
+		})
+	}
+	sort.Slice(paused, func(i, j int) bool { return paused[i].ID < paused[j].ID })
+	return paused
+}
+
+// ResumePacket applies any edits to a paused packet and then releases, steps
+// past or drops it. If an edit can't be made, or the packet can't be dropped,
+// the packet stays paused.
+func (s *Server) ResumePacket(id int, action ResumeAction, edits ...PacketEdit) error {
+	// Checked up front so that a bad edit can't allocate more than a packet's
+	// worth while every other debugger call waits.
+	for _, edit := range edits {
+		if edit.Offset < 0 || edit.Size < 0 {
+			return fmt.Errorf("invalid edit")
+		}
+		if edit.Offset+len(edit.Data) > maxPacketSize || edit.Size > maxPacketSize {
+			return fmt.Errorf("edit extends past the 0x%X byte packet size limit", maxPacketSize)
+		}
+	}
+
+	d := s.debugger
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p := d.paused[id]
+	if p == nil {
+		return fmt.Errorf("no paused packet %d", id)
+	}
+	if action == Drop {
+		if err := p.canDrop(); err != nil {
+			return err
+		}
+	}
+	if len(edits) > 0 && action != Drop {
+		data := p.packet.DecryptedData
+		for _, edit := range edits {
+			data = edit.apply(data)
+		}
+		if err := p.edit(data); err != nil {
+			return err
+		}
+	}
+	delete(d.paused, id)
+	p.resume <- action
+	return nil
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/dcrodman/archon/util"
+)
+
+// StreamDecoder splits one direction of a session's encrypted byte stream into
+// packets. It does the same job as an Interceptor for traffic that has already
+// been captured rather than read off of a live connection.
+type StreamDecoder struct {
+	ServerName string
+	Name       string
+	Crypt      Crypt
+
+	protocol   Protocol
+	headerSize uint16
+	pending    []byte
+	// The current packet's header once enough bytes have arrived to decrypt it.
+	header          *Header
+	rawHeader       []byte
+	decryptedHeader []byte
+}
+
+// NewStreamDecoder returns a StreamDecoder for the direction of a session on
+// serverName sent by name ("Client" or "Server"), decrypted with crypt.
+func NewStreamDecoder(serverName, name string, protocol Protocol, crypt Crypt) *StreamDecoder {
+	return &StreamDecoder{
+		ServerName: serverName,
+		Name:       name,
+		Crypt:      crypt,
+		protocol:   protocol,
+		headerSize: protocol.headerSize(),
+	}
+}
+
+// Write appends the next chunk of the stream, seen at timestamp, and returns any
+// packets that it completes. A *FramingError means the stream can't be decoded
+// any further.
+func (d *StreamDecoder) Write(data []byte, timestamp time.Time) ([]*PacketMsg, error) {
+	d.pending = append(d.pending, data...)
+
+	var packets []*PacketMsg
+	for {
+		if d.header == nil {
+			if len(d.pending) < int(d.headerSize) {
+				break
+			}
+			// Each byte must only be decrypted once since not every cipher is stateless.
+			d.rawHeader = d.take(d.headerSize)
+			d.decryptedHeader = d.decrypt(d.rawHeader)
+			d.header = new(Header)
+			util.StructFromBytes(d.decryptedHeader, d.header)
+			if reason := checkHeader(*d.header, d.headerSize); reason != "" {
+				return packets, &FramingError{
+					Header:        *d.header,
+					Reason:        reason,
+					Data:          d.rawHeader,
+					DecryptedData: d.decryptedHeader,
+				}
+			}
+		}
+
+		remainingSize := paddedSize(*d.header, d.headerSize) - d.headerSize
+		if len(d.pending) < int(remainingSize) {
+			break
+		}
+		remBuf := d.take(remainingSize)
+		packets = append(packets, &PacketMsg{
+			Command:       d.header.Type,
+			Size:          d.headerSize + remainingSize,
+			Data:          append(d.rawHeader, remBuf...),
+			DecryptedData: append(d.decryptedHeader, d.decrypt(remBuf)...),
+			Timestamp:     timestamp,
+			Server:        d.ServerName,
+			FromName:      d.Name,
+			Protocol:      d.protocol,
+		})
+		d.header = nil
+	}
+	return packets, nil
+}
+
+// Buffered returns the number of bytes received that aren't part of a packet yet.
+func (d *StreamDecoder) Buffered() int {
+	n := len(d.pending)
+	if d.header != nil {
+		n += len(d.rawHeader)
+	}
+	return n
+}
+
+// Removes and returns the next n bytes of the stream.
+func (d *StreamDecoder) take(n uint16) []byte {
+	buf := append([]byte(nil), d.pending[:n]...)
+	d.pending = d.pending[n:]
+	return buf
+}
+
+func (d *StreamDecoder) decrypt(buf []byte) []byte {
+	decrypted := append([]byte(nil), buf...)
+	d.Crypt.Decrypt(decrypted, uint32(len(decrypted)))
+	return decrypted
+}
+
+// Number of consecutive plausible headers needed to trust a resynchronization.
+const resyncMinPackets = 3
+
+// FindPacketStart searches data, taken from part way through one direction of
+// a session, for the offset at which a run of plausible packet headers begins.
+// This only works for ciphers that encrypt each block independently, like BB's;
+// it returns false if no such run could be found.
+func FindPacketStart(crypt Crypt, protocol Protocol, data []byte) (int, bool) {
+	headerSize := int(protocol.headerSize())
+	for offset := 0; offset+headerSize <= len(data); offset++ {
+		count, end, ok := headerChain(crypt, headerSize, data[offset:])
+		if ok && (count >= resyncMinPackets || (count > 1 && end == len(data)-offset)) {
+			return offset, true
+		}
+	}
+	return 0, false
+}
+
+// Follows packet headers from the start of data, returning how many complete
+// packets were found and where they end. Returns false if a header is invalid.
+func headerChain(crypt Crypt, headerSize int, data []byte) (int, int, bool) {
+	count, pos := 0, 0
+	for pos+headerSize <= len(data) {
+		buf := append([]byte(nil), data[pos:pos+headerSize]...)
+		crypt.Decrypt(buf, uint32(headerSize))
+		var header Header
+		util.StructFromBytes(buf, &header)
+		if checkHeader(header, uint16(headerSize)) != "" || header.Type > 0x0FFF {
+			return count, pos, false
+		}
+		size := int(paddedSize(header, uint16(headerSize)))
+		if pos+size > len(data) {
+			break
+		}
+		pos += size
+		count++
+	}
+	return count, pos, true
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+)
+
+// Largest packet we expect either side to send. Anything bigger is almost
+// certainly the product of decrypting with the wrong keys.
+const maxPacketSize = 0x8000
+
+// FramingError reports a packet header that no well-behaved peer would send,
+// which usually means that our cipher has lost sync with the stream.
+type FramingError struct {
+	Header Header
+	Reason string
+	// The offending header bytes as read off of the wire and after decryption.
+	Data          []byte
+	DecryptedData []byte
+}
+
+func (e *FramingError) Error() string {
+	return fmt.Sprintf("invalid packet header (size %d, type %04x): %s",
+		e.Header.Size, e.Header.Type, e.Reason)
+}
+
+// Packet wraps the error in a PacketMsg so that it can reach the sinks in order
+// with the rest of the session's traffic.
+func (e *FramingError) Packet(serverName, fromName string, timestamp time.Time) *PacketMsg {
+	return &PacketMsg{
+		Command:       e.Header.Type,
+		Size:          uint16(len(e.DecryptedData)),
+		Data:          e.Data,
+		DecryptedData: e.DecryptedData,
+		Timestamp:     timestamp,
+		Server:        serverName,
+		FromName:      fromName,
+		Err:           e,
+	}
+}
+
+// Returns the reason that a decrypted header can't be right, or an empty string
+// if it looks plausible.
+func checkHeader(header Header, headerSize uint16) string {
+	switch {
+	case header.Size < headerSize:
+		return fmt.Sprintf("size is smaller than the %d byte header", headerSize)
+	case header.Size > maxPacketSize:
+		return fmt.Sprintf("size exceeds the %d byte maximum", maxPacketSize)
+	case header.Type == 0:
+		return "packet type is zero"
+	}
+	return ""
+}
+
+// Packets are padded out to a multiple of the header size (which is also the
+// cipher's block size) on the wire.
+func paddedSize(header Header, headerSize uint16) uint16 {
+	size := header.Size
+	if rem := size % headerSize; rem != 0 {
+		size += headerSize - rem
+	}
+	return size
+}
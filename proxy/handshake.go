@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/dcrodman/archon/util"
+)
+
+// Protocol identifies the variant of the PSO protocol spoken on a connection,
+// as determined from the server's welcome packet.
+type Protocol int
+
+const (
+	// ProtocolBB is the Blue Burst game protocol: 8 byte headers, Blowfish encryption.
+	ProtocolBB Protocol = iota
+	// ProtocolPatch is the patch server protocol: 4 byte headers, PC encryption.
+	ProtocolPatch
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolBB:
+		return "BB"
+	case ProtocolPatch:
+		return "Patch"
+	}
+	return fmt.Sprintf("Protocol(%d)", int(p))
+}
+
+// Size of the packet header for the protocol, which is also the size of the
+// encryption blocks.
+func (p Protocol) headerSize() uint16 {
+	if p == ProtocolPatch {
+		return patchHeaderSize
+	}
+	return bbHeaderSize
+}
+
+const (
+	bbHeaderSize    = 8
+	patchHeaderSize = 4
+
+	bbCopyright    = "Phantasy Star Online Blue Burst Game Backend. Copyright 1999-2004 SONICTEAM."
+	patchCopyright = "Patch Server. Copyright SonicTeam, LTD. 2001"
+
+	// Size of the Header struct shared by both protocols.
+	welcomeHeaderSize = 4
+	// Largest welcome packet we're prepared to accept; both known ones are well under.
+	maxWelcomeSize = 0x400
+
+	defaultHandshakeTimeout = 10 * time.Second
+)
+
+// readWelcome reads the unencrypted welcome packet sent by the server when a
+// connection is opened and determines which protocol the server speaks. The whole
+// packet, as declared by its header, must arrive within timeout.
+func readWelcome(conn net.Conn, timeout time.Duration) ([]byte, Protocol, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, welcomeHeaderSize)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, 0, fmt.Errorf("failed to read welcome header: %s", err.Error())
+	}
+	var header Header
+	util.StructFromBytes(buf, &header)
+	if err := checkWelcomeHeader(header); err != nil {
+		return nil, 0, err
+	}
+
+	buf = append(buf, make([]byte, header.Size-welcomeHeaderSize)...)
+	if _, err := io.ReadFull(conn, buf[welcomeHeaderSize:]); err != nil {
+		return nil, 0, fmt.Errorf("failed to read %d byte welcome packet: %s", header.Size, err.Error())
+	}
+
+	protocol, err := detectProtocol(header, buf)
+	return buf, protocol, err
+}
+
+// ParseWelcome extracts the unencrypted welcome packet from the start of a
+// captured server stream and determines which protocol the server speaks. If buf
+// doesn't yet hold the whole packet, io.ErrUnexpectedEOF is returned.
+func ParseWelcome(buf []byte) ([]byte, Protocol, error) {
+	if len(buf) < welcomeHeaderSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	var header Header
+	util.StructFromBytes(buf, &header)
+	if err := checkWelcomeHeader(header); err != nil {
+		return nil, 0, err
+	}
+	if len(buf) < int(header.Size) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	welcome := buf[:header.Size]
+	protocol, err := detectProtocol(header, welcome)
+	return welcome, protocol, err
+}
+
+// NewWelcomePacket wraps a welcome packet sent by the server on serverName.
+func NewWelcomePacket(serverName string, welcome []byte, timestamp time.Time) *PacketMsg {
+	var header Header
+	util.StructFromBytes(welcome, &header)
+	protocol, _ := detectProtocol(header, welcome)
+	return &PacketMsg{
+		Size:          uint16(len(welcome)),
+		Command:       header.Type,
+		Data:          welcome,
+		DecryptedData: welcome,
+		Timestamp:     timestamp,
+		Server:        serverName,
+		FromName:      "Server",
+		Protocol:      protocol,
+	}
+}
+
+func checkWelcomeHeader(header Header) error {
+	if header.Size < welcomeHeaderSize || header.Size > maxWelcomeSize {
+		return fmt.Errorf("implausible welcome packet size %d (type %02x)", header.Size, header.Type)
+	}
+	return nil
+}
+
+// Validates the welcome packet's command, size and copyright string and returns the
+// protocol variant they correspond to.
+func detectProtocol(header Header, buf []byte) (Protocol, error) {
+	switch {
+	case header.Type == BBWelcomeType && len(buf) >= 0xC8 &&
+		bytes.HasPrefix(buf[bbHeaderSize:], []byte(bbCopyright)):
+		return ProtocolBB, nil
+	case header.Type == PatchWelcomeType && len(buf) >= 0x4C &&
+		bytes.HasPrefix(buf[patchHeaderSize:], []byte(patchCopyright)):
+		return ProtocolPatch, nil
+	}
+	return 0, fmt.Errorf("unrecognized welcome packet (type %02x, %d bytes)", header.Type, len(buf))
+}
+
+// The ciphers for both legs of a session. When encryption is terminated at the
+// proxy the client leg uses vectors of our own, otherwise both legs share the
+// server's and nothing is re-encrypted.
+type sessionCrypts struct {
+	fromClient, toClient Crypt
+	fromServer, toServer Crypt
+	// The welcome packet to send on to the client.
+	clientWelcome []byte
+}
+
+func (s *Server) buildSessionCrypts(protocol Protocol, welcome []byte) (*sessionCrypts, error) {
+	clientCrypt, serverCrypt, err := s.cryptBuilder(protocol, welcome)
+	if err != nil {
+		return nil, err
+	}
+	if !s.terminateEncryption {
+		return &sessionCrypts{fromClient: clientCrypt, fromServer: serverCrypt, clientWelcome: welcome}, nil
+	}
+
+	clientWelcome, err := newProxyWelcome(protocol, welcome)
+	if err != nil {
+		return nil, err
+	}
+	proxyClientCrypt, proxyServerCrypt, err := s.cryptBuilder(protocol, clientWelcome)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionCrypts{
+		fromClient:    proxyClientCrypt,
+		toClient:      proxyServerCrypt,
+		fromServer:    serverCrypt,
+		toServer:      clientCrypt,
+		clientWelcome: clientWelcome,
+	}, nil
+}
+
+// Returns a copy of the server's welcome packet with freshly generated vectors
+// for the proxy to use with the client.
+func newProxyWelcome(protocol Protocol, welcome []byte) ([]byte, error) {
+	var vectors []byte
+	var newWelcome []byte
+	switch protocol {
+	case ProtocolBB:
+		var pkt WelcomePkt
+		util.StructFromBytes(welcome, &pkt)
+		vectors = make([]byte, len(pkt.ServerVector)+len(pkt.ClientVector))
+		if _, err := rand.Read(vectors); err != nil {
+			return nil, err
+		}
+		copy(pkt.ServerVector[:], vectors)
+		copy(pkt.ClientVector[:], vectors[len(pkt.ServerVector):])
+		newWelcome, _ = util.BytesFromStruct(pkt)
+	case ProtocolPatch:
+		var pkt PatchWelcomePkt
+		util.StructFromBytes(welcome, &pkt)
+		vectors = make([]byte, len(pkt.ServerVector)+len(pkt.ClientVector))
+		if _, err := rand.Read(vectors); err != nil {
+			return nil, err
+		}
+		copy(pkt.ServerVector[:], vectors)
+		copy(pkt.ClientVector[:], vectors[len(pkt.ServerVector):])
+		newWelcome, _ = util.BytesFromStruct(pkt)
+	default:
+		return nil, fmt.Errorf("no welcome packet for protocol %s", protocol)
+	}
+	// Keep anything past the end of the struct that the server sent.
+	return append(newWelcome, welcome[len(newWelcome):]...), nil
+}
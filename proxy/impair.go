@@ -0,0 +1,335 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Impairment describes the network conditions to simulate on the packets sent in
+// one direction of a proxy's sessions. The zero value forwards packets as soon as
+// they have been read.
+type Impairment struct {
+	// Delay added to every packet, varied at random by up to Jitter either way.
+	// Packets are never reordered, so a packet may wait longer than its own delay
+	// for the one ahead of it.
+	Latency time.Duration
+	Jitter  time.Duration
+	// Bytes per second; 0 means no limit.
+	Bandwidth int
+	// Hold on to packets until the pause is lifted.
+	Paused bool
+}
+
+// ParseImpairment reads an Impairment from a comma separated list of settings
+// such as "latency=200ms,jitter=50ms,bandwidth=8192,paused". An empty string or
+// "none" is no impairment.
+func ParseImpairment(spec string) (Impairment, error) {
+	var imp Impairment
+	if spec == "" || spec == "none" {
+		return imp, nil
+	}
+	for _, setting := range strings.Split(spec, ",") {
+		name, value := setting, ""
+		if i := strings.Index(setting, "="); i >= 0 {
+			name, value = setting[:i], setting[i+1:]
+		}
+		var err error
+		switch strings.TrimSpace(name) {
+		case "latency":
+			imp.Latency, err = time.ParseDuration(value)
+		case "jitter":
+			imp.Jitter, err = time.ParseDuration(value)
+		case "bandwidth":
+			imp.Bandwidth, err = strconv.Atoi(value)
+		case "paused":
+			imp.Paused = true
+			if value != "" {
+				imp.Paused, err = strconv.ParseBool(value)
+			}
+		default:
+			return imp, fmt.Errorf("unknown impairment setting %q", name)
+		}
+		if err != nil {
+			return imp, fmt.Errorf("invalid %s: %s", name, err.Error())
+		}
+	}
+	if imp.Latency < 0 || imp.Jitter < 0 || imp.Bandwidth < 0 {
+		return imp, fmt.Errorf("impairment settings can't be negative")
+	}
+	return imp, nil
+}
+
+// String returns the impairment in the format accepted by ParseImpairment.
+func (imp Impairment) String() string {
+	var settings []string
+	if imp.Latency > 0 {
+		settings = append(settings, "latency="+imp.Latency.String())
+	}
+	if imp.Jitter > 0 {
+		settings = append(settings, "jitter="+imp.Jitter.String())
+	}
+	if imp.Bandwidth > 0 {
+		settings = append(settings, "bandwidth="+strconv.Itoa(imp.Bandwidth))
+	}
+	if imp.Paused {
+		settings = append(settings, "paused")
+	}
+	if len(settings) == 0 {
+		return "none"
+	}
+	return strings.Join(settings, ",")
+}
+
+// Returns the delay for the next packet.
+func (imp Impairment) delay() time.Duration {
+	delay := imp.Latency
+	if imp.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(2*imp.Jitter+1))) - imp.Jitter
+	}
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+// The impairment of one direction of a proxy, shared by the Interceptors of all
+// of its sessions so that changes apply to those already running.
+type impairmentSetting struct {
+	mu         sync.Mutex
+	impairment Impairment
+	// Closed and replaced on every change to wake up senders waiting on a pause.
+	changed chan struct{}
+}
+
+func newImpairmentSetting(imp Impairment) *impairmentSetting {
+	return &impairmentSetting{impairment: imp, changed: make(chan struct{})}
+}
+
+func (s *impairmentSetting) get() (Impairment, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.impairment, s.changed
+}
+
+func (s *impairmentSetting) set(imp Impairment) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.impairment = imp
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// A packet waiting to be sent by an impairedSender.
+type queuedPacket struct {
+	data    []byte
+	arrived time.Time
+	sent    func()
+}
+
+// Sends an Interceptor's packets from a goroutine of its own while an impairment
+// is in effect, so that holding up one session doesn't hold up the rest. Packets
+// are queued already encrypted and sent strictly in order, which keeps the
+// stream in step with the ciphers no matter how long each is held. The queue
+// has no limit, since the proxy keeps reading from the other side regardless.
+type impairedSender struct {
+	setting *impairmentSetting
+
+	mu    sync.Mutex
+	queue []queuedPacket
+	// Packets queued or being sent; while nonzero, new packets have to queue up
+	// behind them even if the impairment has been lifted.
+	pending int
+	stopped bool
+	wake    chan struct{}
+	stop    chan struct{}
+}
+
+func newImpairedSender(setting *impairmentSetting) *impairedSender {
+	return &impairedSender{
+		setting: setting,
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Queues the packet unless it can be sent straight away, returning whether it was.
+func (s *impairedSender) enqueue(packet queuedPacket) bool {
+	imp, _ := s.setting.get()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if imp == (Impairment{}) && s.pending == 0 {
+		return false
+	}
+	if !s.stopped {
+		s.queue = append(s.queue, packet)
+		s.pending++
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+// Blocks until there's a packet to send, returning false if the sender stopped.
+func (s *impairedSender) next() (queuedPacket, bool) {
+	for {
+		s.mu.Lock()
+		if len(s.queue) > 0 {
+			packet := s.queue[0]
+			s.queue[0] = queuedPacket{}
+			s.queue = s.queue[1:]
+			s.mu.Unlock()
+			return packet, true
+		}
+		s.mu.Unlock()
+		select {
+		case <-s.wake:
+		case <-s.stop:
+			return queuedPacket{}, false
+		}
+	}
+}
+
+func (s *impairedSender) finished() {
+	s.mu.Lock()
+	s.pending--
+	s.mu.Unlock()
+}
+
+// Waits until t, returning false if the sender was stopped in the meantime.
+func (s *impairedSender) sleepUntil(t time.Time) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-s.stop:
+		return false
+	}
+}
+
+// Waits out a pause, returning the impairment in effect afterwards or false if
+// the sender was stopped.
+func (s *impairedSender) awaitUnpaused() (Impairment, bool) {
+	for {
+		imp, changed := s.setting.get()
+		if !imp.Paused {
+			return imp, true
+		}
+		select {
+		case <-changed:
+		case <-s.stop:
+			return imp, false
+		}
+	}
+}
+
+// Stops the sender and drops anything still queued.
+func (s *impairedSender) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.stopped {
+		s.stopped = true
+		s.queue = nil
+		close(s.stop)
+	}
+}
+
+// Sends the packets queued on the sender until it's stopped.
+func (s *impairedSender) run(send func(data []byte) error) {
+	// When the link will be done with the last packet at the bandwidth limit.
+	var linkFree time.Time
+	for {
+		packet, ok := s.next()
+		if !ok {
+			return
+		}
+		imp, ok := s.awaitUnpaused()
+		if !ok {
+			return
+		}
+		release := packet.arrived.Add(imp.delay())
+		if release.Before(linkFree) {
+			release = linkFree
+		}
+		if !s.sleepUntil(release) {
+			return
+		}
+		// The pause may have started while the packet was being held.
+		if _, ok := s.awaitUnpaused(); !ok {
+			return
+		}
+
+		if err := send(packet.data); err != nil {
+			s.close()
+			return
+		}
+		if imp.Bandwidth > 0 {
+			linkFree = time.Now().Add(time.Duration(len(packet.data)) * time.Second / time.Duration(imp.Bandwidth))
+		}
+		packet.sent()
+		s.finished()
+	}
+}
+
+// Names of the two directions of a session, after the side the packets come from.
+var directions = []string{"Client", "Server"}
+
+// ImpairmentStatus is the impairment in effect for one direction of a proxy.
+type ImpairmentStatus struct {
+	Server string
+	// Which side the impaired packets come from, "Client" or "Server".
+	Direction  string
+	Impairment Impairment
+}
+
+// Impairments returns the impairment in effect for each proxy and direction.
+func (s *Server) Impairments() []ImpairmentStatus {
+	var statuses []ImpairmentStatus
+	for _, proxy := range s.proxies {
+		for _, direction := range directions {
+			imp, _ := proxy.impairments[direction].get()
+			statuses = append(statuses, ImpairmentStatus{
+				Server:     proxy.serverName,
+				Direction:  direction,
+				Impairment: imp,
+			})
+		}
+	}
+	return statuses
+}
+
+// SetImpairment changes the impairment of the packets coming from direction
+// ("Client" or "Server") on the named proxy, including those of sessions already
+// running. An empty serverName or direction applies it to every proxy or both
+// directions.
+func (s *Server) SetImpairment(serverName, direction string, imp Impairment) error {
+	if direction != "" && direction != "Client" && direction != "Server" {
+		return fmt.Errorf("unknown direction %q", direction)
+	}
+	found := false
+	for _, proxy := range s.proxies {
+		if serverName != "" && proxy.serverName != serverName {
+			continue
+		}
+		found = true
+		for _, d := range directions {
+			if direction == "" || direction == d {
+				proxy.impairments[d].set(imp)
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("no proxy for server %q", serverName)
+	}
+	return nil
+}
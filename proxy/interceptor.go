@@ -0,0 +1,307 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/dcrodman/archon/util"
+)
+
+var errSessionEnded = errors.New("Session ended")
+
+// Interceptor objects are responsible for reading packets off of the wire for one direction
+// of a session. For every connection, there should be one Interceptor for the client->proxy
+// side and one for the proxy->server.
+type Interceptor struct {
+	ServerName string
+	Name       string
+	RecvConn   net.Conn
+	RecvCrypt  Crypt
+	SendConn   net.Conn
+	// Re-encrypts packets for SendConn when encryption is terminated at the
+	// proxy; nil if the original bytes are forwarded as-is.
+	SendCrypt Crypt
+	Partner   *Interceptor
+	stop      int32
+
+	server    *Server
+	protocol  Protocol
+	sessionID uint64
+	// Holds packets back while the proxy's impairment for this direction is set.
+	sender *impairedSender
+	// Receives copies of the client's packets and has the server's compared with
+	// its own, if the session is being shadowed.
+	shadow *shadowSession
+}
+
+// Start runs the packet processing loop for the interceptor's connection.
+func (i *Interceptor) Start() {
+	go i.sender.run(func(data []byte) error {
+		err := i.send(data, uint16(len(data)))
+		if err != nil {
+			i.server.logger.Printf("Failed to send packet: %s\n", err.Error())
+		}
+		return err
+	})
+	defer i.sender.close()
+
+	for {
+		packet, err := i.readNextPacket()
+		if err == errSessionEnded || err == io.EOF {
+			break
+		} else if framingErr, ok := err.(*FramingError); ok {
+			// There's no recovering the packet boundaries once we've lost them, so
+			// record what we saw and drop the session.
+			i.server.logger.Printf("Desync reading from %s: %s\n", i.RecvConn.RemoteAddr().String(), err.Error())
+			i.server.metrics.framingErrors.WithLabelValues(i.ServerName, i.Name).Inc()
+			i.server.packetChan <- i.tag(framingErr.Packet(i.ServerName, i.Name, time.Now()))
+			break
+		} else if err != nil {
+			i.server.logger.Printf("Error reading from %s: %s\n", i.RecvConn.RemoteAddr().String(), err.Error())
+			break
+		}
+
+		if i.shadow != nil && i.Name == "Server" {
+			i.shadow.compare(packet, i.Name)
+		}
+		i.rewriteRedirect(packet)
+		for _, hook := range i.server.hooks {
+			hook(packet)
+		}
+		if !i.pauseAtBreakpoint(i.tag(packet)) {
+			i.server.logger.Printf("Dropped %s packet %04x from %s\n", i.ServerName, packet.Command, i.Name)
+			continue
+		}
+		if i.shadow != nil && i.Name == "Client" {
+			i.shadow.forward(packet)
+		}
+
+		packet.sendFunc = func() {
+			i.server.debug(fmt.Sprintf("Sending %d bytes to %s", packet.Size, packet.FromName))
+			data := packet.Data
+			if i.SendCrypt != nil {
+				data = i.reencrypt(packet)
+			}
+			if err := i.forward(packet, data); err != nil {
+				i.server.logger.Printf("Failed to send packet: %s\n", err.Error())
+			}
+		}
+		i.server.packetChan <- i.tag(packet)
+	}
+
+	i.RecvConn.Close()
+	i.Partner.Kill()
+	i.server.logger.Printf("Closed %s connection on %s (%s)\n\n",
+		i.Name, i.RecvConn.RemoteAddr().String(), i.ServerName)
+}
+
+func (i *Interceptor) readNextPacket() (*PacketMsg, error) {
+	// Just read in the header so we know how much data we're expecting.
+	headerSize := i.protocol.headerSize()
+	buf := make([]byte, headerSize)
+	i.server.debug("Awaiting header from " + i.Name)
+	err := i.readBytes(buf, headerSize)
+	if err != nil {
+		return nil, err
+	}
+
+	decryptedBuf := i.decryptData(buf, headerSize)
+	var packetHeader Header
+	util.StructFromBytes(decryptedBuf, &packetHeader)
+	if reason := checkHeader(packetHeader, headerSize); reason != "" {
+		return nil, &FramingError{
+			Header:        packetHeader,
+			Reason:        reason,
+			Data:          buf,
+			DecryptedData: decryptedBuf,
+		}
+	}
+
+	// Now we read in the rest of the packet and append it to what we have.
+	packetSize := paddedSize(packetHeader, headerSize)
+	remainingSize := packetSize - headerSize
+
+	remBuf := make([]byte, remainingSize)
+	i.server.debug("Awaiting rest of packet from " + i.Name)
+	err = i.readBytes(remBuf, remainingSize)
+	if err != nil {
+		return nil, err
+	}
+	decryptedRemBuf := i.decryptData(remBuf, remainingSize)
+
+	packet := PacketMsg{
+		Command:       packetHeader.Type,
+		Size:          packetSize,
+		Data:          append(buf, remBuf...),
+		DecryptedData: append(decryptedBuf, decryptedRemBuf...),
+		Timestamp:     time.Now(),
+		Server:        i.ServerName,
+		FromName:      i.Name,
+		Protocol:      i.protocol,
+	}
+	return &packet, err
+}
+
+// Marks the packet with the session that it belongs to.
+func (i *Interceptor) tag(packet *PacketMsg) *PacketMsg {
+	packet.SessionID = i.sessionID
+	if i.Name == "Client" {
+		packet.ClientAddr = i.RecvConn.RemoteAddr().String()
+	} else {
+		packet.ClientAddr = i.SendConn.RemoteAddr().String()
+	}
+	return packet
+}
+
+func (i *Interceptor) readBytes(buf []byte, bytesToRead uint16) error {
+	i.server.debug(fmt.Sprintf("%d total bytes to read from %s", bytesToRead, i.Name))
+	for bytesReceived := uint16(0); bytesReceived < bytesToRead; {
+		// Timeouts give us an opportunity to check if the connection is dead.
+		i.RecvConn.SetReadDeadline(time.Now().Add(time.Second))
+		bytesRead, err := i.RecvConn.Read(buf[bytesReceived:bytesToRead])
+
+		if err != nil {
+			netErr, ok := err.(net.Error)
+			if !ok || !netErr.Timeout() {
+				return err
+			} else if i.stopped() {
+				return errSessionEnded
+			}
+		}
+		i.server.debug(fmt.Sprintf("%d bytes of %d read from %s", bytesRead, bytesToRead, i.Name))
+		bytesReceived += uint16(bytesRead)
+	}
+	return nil
+}
+
+func (i *Interceptor) decryptData(buf []byte, size uint16) []byte {
+	decryptedBuf := append(make([]byte, 0), buf...)
+	i.RecvCrypt.Decrypt(decryptedBuf, uint32(size))
+	return decryptedBuf
+}
+
+// Rewrite the connection parameters to point back at the proxy.
+func (i *Interceptor) rewriteRedirect(packet *PacketMsg) {
+	var packetStruct interface{}
+	var host string
+	var port uint16
+
+	if packet.Command == RedirectType {
+		var redirectPkt RedirectPacket
+		util.StructFromBytes(packet.DecryptedData, &redirectPkt)
+
+		target := i.server.getProxy(redirectPkt.Port)
+		if target == nil {
+			return
+		}
+		// The client is always on the receiving end of a redirect.
+		addr := target.redirectAddr(i.SendConn.RemoteAddr())
+		copy(redirectPkt.IPAddr[:], addr.ip[:])
+		redirectPkt.Port = uint16(target.listenAddr.Port)
+		host, port = addr.host, redirectPkt.Port
+		packetStruct = redirectPkt
+	}
+
+	if packetStruct != nil {
+		rewrittenBytes, _ := util.BytesFromStruct(packetStruct)
+		copy(packet.DecryptedData, rewrittenBytes)
+		if i.SendCrypt == nil {
+			i.RecvCrypt.Encrypt(rewrittenBytes, uint32(len(rewrittenBytes)))
+			copy(packet.Data, rewrittenBytes)
+		}
+		i.server.logger.Printf("Rewrote redirect packet IP to %s:%d\n\n", host, port)
+	}
+}
+
+// Encrypts the packet's decrypted data, which may have been modified to any size,
+// for the receiving side. The header's size field is left up to whoever changed it.
+func (i *Interceptor) reencrypt(packet *PacketMsg) []byte {
+	data := append([]byte(nil), packet.DecryptedData...)
+	for len(data)%int(i.protocol.headerSize()) != 0 {
+		data = append(data, 0)
+	}
+	i.SendCrypt.Encrypt(data, uint32(len(data)))
+	return data
+}
+
+// Sends the packet's data on to its destination, or queues it to go out later if
+// the direction is impaired. Errors are only returned for packets sent straight
+// away; the sender reports its own.
+func (i *Interceptor) forward(packet *PacketMsg, data []byte) error {
+	queued := i.sender.enqueue(queuedPacket{
+		data:    data,
+		arrived: packet.Timestamp,
+		sent:    func() { i.server.metrics.packetForwarded(packet) },
+	})
+	if queued {
+		return nil
+	}
+	if err := i.send(data, uint16(len(data))); err != nil {
+		return err
+	}
+	i.server.metrics.packetForwarded(packet)
+	return nil
+}
+
+func (i *Interceptor) send(data []byte, size uint16) error {
+	for bytesSent := uint16(0); bytesSent < size; {
+		n, err := i.SendConn.Write(data[bytesSent:size])
+		if err != nil {
+			return err
+		}
+		bytesSent += uint16(n)
+	}
+	return nil
+}
+
+// Replaces the packet's contents with data, an edited copy of its decrypted
+// bytes. Unless encryption is terminated at the proxy, the original stream has
+// to be kept in step with the ciphers of both ends, so edits can't change the
+// size of packets and are only possible with the BB cipher, which encrypts
+// each block independently.
+func (i *Interceptor) editPacket(packet *PacketMsg, data []byte) error {
+	headerSize := int(i.protocol.headerSize())
+	if len(data) < headerSize || len(data) > maxPacketSize {
+		return fmt.Errorf("packets must be between %d and %d bytes", headerSize, maxPacketSize)
+	}
+	if i.SendCrypt == nil {
+		if len(data) != len(packet.DecryptedData) {
+			return errors.New("packets can only change size when encryption is terminated at the proxy")
+		}
+		if i.protocol != ProtocolBB {
+			return errors.New("patch packets can only be edited when encryption is terminated at the proxy")
+		}
+		encrypted := append([]byte(nil), data...)
+		i.RecvCrypt.Encrypt(encrypted, uint32(len(encrypted)))
+		packet.Data = encrypted
+	}
+	var header Header
+	util.StructFromBytes(data, &header)
+	packet.Command = header.Type
+	packet.Size = uint16(len(data))
+	packet.DecryptedData = data
+	return nil
+}
+
+// Returns an error unless the packet can be left out of the stream. Without
+// encryption terminated at the proxy, the peer's cipher has to see every packet
+// of a patch session, since its keystream carries on from one to the next.
+func (i *Interceptor) canDrop() error {
+	if i.SendCrypt == nil && i.protocol != ProtocolBB {
+		return errors.New("patch packets can only be dropped when encryption is terminated at the proxy")
+	}
+	return nil
+}
+
+func (i *Interceptor) stopped() bool {
+	return atomic.LoadInt32(&i.stop) > 0
+}
+
+// Kill will cause the Interceptor to stop processing packets and return from Start().
+func (i *Interceptor) Kill() {
+	atomic.AddInt32(&i.stop, 1)
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dcrodman/archon/util"
+)
+
+// Label at the start of every key log line, in the spirit of SSLKEYLOGFILE.
+const keyLogLabel = "PSO_SESSION"
+
+// KeyLogEntry records the encryption vectors used on one TCP connection so that
+// captures of it can be decrypted later. BB's cipher works on independent 8 byte
+// blocks, so the vectors are all that's needed to decrypt any part of the stream.
+type KeyLogEntry struct {
+	Timestamp    time.Time
+	Protocol     Protocol
+	Client       string
+	Server       string
+	ServerVector []byte
+	ClientVector []byte
+}
+
+// String formats the entry as a key log line:
+//
+//	PSO_SESSION <time> <protocol> <client addr> <server addr> <server vector> <client vector>
+func (e KeyLogEntry) String() string {
+	return fmt.Sprintf("%s %s %s %s %s %s %s", keyLogLabel, e.Timestamp.Format(time.RFC3339Nano),
+		e.Protocol, e.Client, e.Server, hex.EncodeToString(e.ServerVector), hex.EncodeToString(e.ClientVector))
+}
+
+// Welcome reconstructs a welcome packet carrying the entry's vectors, suitable for
+// passing to a CryptBuilder.
+func (e KeyLogEntry) Welcome() []byte {
+	var welcome []byte
+	switch e.Protocol {
+	case ProtocolPatch:
+		pkt := PatchWelcomePkt{Header: Header{Size: 0x4C, Type: PatchWelcomeType}}
+		copy(pkt.Copyright[:], patchCopyright)
+		copy(pkt.ServerVector[:], e.ServerVector)
+		copy(pkt.ClientVector[:], e.ClientVector)
+		welcome, _ = util.BytesFromStruct(pkt)
+	default:
+		pkt := WelcomePkt{Header: Header{Size: 0xC8, Type: BBWelcomeType}}
+		copy(pkt.Copyright[:], bbCopyright)
+		copy(pkt.ServerVector[:], e.ServerVector)
+		copy(pkt.ClientVector[:], e.ClientVector)
+		welcome, _ = util.BytesFromStruct(pkt)
+	}
+	return welcome
+}
+
+// NewKeyLogEntry extracts the vectors from a welcome packet sent on the connection
+// between client and server.
+func NewKeyLogEntry(protocol Protocol, welcome []byte, client, server string) KeyLogEntry {
+	entry := KeyLogEntry{Timestamp: time.Now(), Protocol: protocol, Client: client, Server: server}
+	switch protocol {
+	case ProtocolPatch:
+		var pkt PatchWelcomePkt
+		util.StructFromBytes(welcome, &pkt)
+		entry.ServerVector, entry.ClientVector = pkt.ServerVector[:], pkt.ClientVector[:]
+	default:
+		var pkt WelcomePkt
+		util.StructFromBytes(welcome, &pkt)
+		entry.ServerVector, entry.ClientVector = pkt.ServerVector[:], pkt.ClientVector[:]
+	}
+	return entry
+}
+
+// KeyLogWriter appends entries to a key log from any number of sessions.
+type KeyLogWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewKeyLogWriter returns a KeyLogWriter that writes lines to w.
+func NewKeyLogWriter(w io.Writer) *KeyLogWriter {
+	return &KeyLogWriter{w: w}
+}
+
+// Write adds an entry to the log.
+func (k *KeyLogWriter) Write(entry KeyLogEntry) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	_, err := fmt.Fprintln(k.w, entry.String())
+	return err
+}
+
+// ReadKeyLog parses the entries in a key log. Blank lines, comments starting with
+// '#' and lines with other labels are skipped.
+func ReadKeyLog(r io.Reader) ([]KeyLogEntry, error) {
+	var entries []KeyLogEntry
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != keyLogLabel {
+			continue
+		}
+		entry, err := parseKeyLogLine(fields)
+		if err != nil {
+			return nil, fmt.Errorf("key log line %d: %s", lineNum, err.Error())
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+func parseKeyLogLine(fields []string) (KeyLogEntry, error) {
+	var entry KeyLogEntry
+	if len(fields) != 7 {
+		return entry, fmt.Errorf("expected 7 fields, got %d", len(fields))
+	}
+	var err error
+	if entry.Timestamp, err = time.Parse(time.RFC3339Nano, fields[1]); err != nil {
+		return entry, err
+	}
+	switch fields[2] {
+	case ProtocolBB.String():
+		entry.Protocol = ProtocolBB
+	case ProtocolPatch.String():
+		entry.Protocol = ProtocolPatch
+	default:
+		return entry, fmt.Errorf("unknown protocol %q", fields[2])
+	}
+	entry.Client, entry.Server = fields[3], fields[4]
+	if entry.ServerVector, err = hex.DecodeString(fields[5]); err != nil {
+		return entry, fmt.Errorf("invalid server vector: %s", err.Error())
+	}
+	if entry.ClientVector, err = hex.DecodeString(fields[6]); err != nil {
+		return entry, fmt.Errorf("invalid client vector: %s", err.Error())
+	}
+	return entry, nil
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "bb_proxy"
+
+// Prometheus collectors tracking the health of a Server. Each Server registers
+// them with its own registry so that several can run in one process.
+type metrics struct {
+	registry *prometheus.Registry
+
+	activeSessions    *prometheus.GaugeVec
+	packets           *prometheus.CounterVec
+	bytes             *prometheus.CounterVec
+	handshakeFailures *prometheus.CounterVec
+	dialErrors        *prometheus.CounterVec
+	upstreamUp        *prometheus.GaugeVec
+	framingErrors     *prometheus.CounterVec
+	forwardLatency    *prometheus.HistogramVec
+}
+
+func newMetrics(s *Server) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		activeSessions: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "active_sessions",
+			Help:      "Number of client sessions currently being proxied.",
+		}, []string{"server"}),
+		packets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "packets_total",
+			Help:      "Packets forwarded by the proxy.",
+		}, []string{"server", "direction", "command"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "bytes_total",
+			Help:      "Bytes forwarded by the proxy.",
+		}, []string{"server", "direction", "command"}),
+		handshakeFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "handshake_failures_total",
+			Help:      "Connections to the upstream server dropped because its welcome packet was missing or invalid.",
+		}, []string{"server"}),
+		dialErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_dial_errors_total",
+			Help:      "Failed attempts to connect to the upstream server.",
+		}, []string{"server"}),
+		upstreamUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_up",
+			Help:      "Whether the last attempt to connect to each upstream server succeeded.",
+		}, []string{"server", "upstream"}),
+		framingErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "framing_errors_total",
+			Help:      "Sessions dropped because a packet header failed validation, usually due to cipher desync.",
+		}, []string{"server", "direction"}),
+		forwardLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "forward_latency_seconds",
+			Help:      "Time from a packet being read in full to it being sent on.",
+			Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}, []string{"server", "direction"}),
+	}
+	queueDepth := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "packet_queue_depth",
+		Help:      "Packets waiting to be processed by the sinks and forwarded.",
+	}, func() float64 { return float64(len(s.packetChan)) })
+
+	m.registry.MustRegister(m.activeSessions, m.packets, m.bytes,
+		m.handshakeFailures, m.dialErrors, m.upstreamUp, m.framingErrors, m.forwardLatency, queueDepth)
+	return m
+}
+
+// Records a packet that has just been sent on to its destination.
+func (m *metrics) packetForwarded(packet *PacketMsg) {
+	command := PacketName(packet.Server, packet.Command)
+	if command == "" {
+		command = fmt.Sprintf("%04x", packet.Command)
+	}
+	m.packets.WithLabelValues(packet.Server, packet.FromName, command).Inc()
+	m.bytes.WithLabelValues(packet.Server, packet.FromName, command).Add(float64(packet.Size))
+	m.forwardLatency.WithLabelValues(packet.Server, packet.FromName).
+		Observe(time.Since(packet.Timestamp).Seconds())
+}
+
+// MetricsHandler returns an http.Handler that serves the Server's metrics in the
+// Prometheus exposition format.
+func (s *Server) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{})
+}
@@ -1,25 +1,37 @@
-package main
+package proxy
 
 import (
 	"time"
 )
 
 const (
-	RedirectType uint16 = 0x19
+	PatchWelcomeType uint16 = 0x02
+	BBWelcomeType    uint16 = 0x03
+	RedirectType     uint16 = 0x19
 )
 
 // PacketMsg contains metadata about a received packet along with the raw
 // bytes of the packet as taken off of the wire.
 type PacketMsg struct {
-	command       uint16
-	size          uint16
-	data          []byte
-	decryptedData []byte
+	Command       uint16
+	Size          uint16
+	Data          []byte
+	DecryptedData []byte
 
-	timestamp time.Time
-	server    string
-	fromName  string
+	Timestamp time.Time
+	Server    string
+	FromName  string
+	Protocol  Protocol
 	sendFunc  func()
+
+	// Identifies the client connection that the packet was exchanged on; IDs are
+	// unique for the lifetime of a Server or capture import.
+	SessionID  uint64
+	ClientAddr string
+
+	// Set instead of a command when the packet could not be read, in which case
+	// the data holds whatever bytes were available.
+	Err error
 }
 
 type Header struct {
@@ -98,10 +110,17 @@ var packetNames = map[string]map[uint16]string{
 		0x05:         "DisconnectType",
 		RedirectType: "RedirectType",
 		0x10:         "MenuSelectType",
+		0x01:         "LobbyMessageType",
+		0x06:         "ChatType",
+		0x11:         "InfoMessageType",
+		0x81:         "SimpleMailType",
+		0xB0:         "TextMessageType",
 	},
 }
 
-func getPacketName(serverName string, packetType uint16) string {
+// PacketName returns the alias for a packet type as sent on the named server, or
+// an empty string if the packet is not known.
+func PacketName(serverName string, packetType uint16) string {
 	name := packetNames[serverName][packetType]
 	if name != "" {
 		return name
@@ -0,0 +1,311 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Proxy objects await connections on their defined ports and spin off Interceptor
+// instances to handle the traffic.
+type Proxy struct {
+	serverName string
+	host       string
+
+	// Resolved at startup so that configuration errors surface immediately.
+	listenAddr *net.TCPAddr
+	upstreams  []*upstream
+	balancing  Balancing
+	// Incremented atomically to take turns between the upstreams.
+	nextUpstream uint32
+	// Addresses to send clients being redirected to this proxy.
+	advertised  advertisedAddr
+	subnetAddrs []advertisedAddr
+
+	server   *Server
+	listener *net.TCPListener
+	// Holds one entry per active session; nil if the number is unlimited.
+	sessions chan struct{}
+	// Keyed by the side the packets come from.
+	impairments map[string]*impairmentSetting
+	// Nil unless sessions are also sent to a shadow server.
+	shadowHost string
+	shadowAddr *net.TCPAddr
+}
+
+func newProxy(server *Server, config ProxyConfig, serverSubnetAddrs []advertisedAddr) (*Proxy, error) {
+	listenAddr, err := resolveTCPAddr(config.Host)
+	if err != nil {
+		return nil, err
+	}
+	remoteHosts := config.RemoteHosts
+	if len(remoteHosts) == 0 {
+		remoteHosts = []string{config.RemoteHost}
+	}
+	var upstreams []*upstream
+	for _, host := range remoteHosts {
+		addr, err := resolveTCPAddr(host)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, &upstream{host: host, addr: addr})
+		server.metrics.upstreamUp.WithLabelValues(config.ServerName, host).Set(1)
+	}
+	advertised, err := resolveAdvertisedAddr(config.AdvertisedHost)
+	if err != nil {
+		return nil, err
+	}
+	subnetAddrs, err := resolveSubnetAddresses(config.AdvertisedSubnets)
+	if err != nil {
+		return nil, err
+	}
+	proxy := &Proxy{
+		serverName:  config.ServerName,
+		host:        config.Host,
+		listenAddr:  listenAddr,
+		upstreams:   upstreams,
+		balancing:   config.Balancing,
+		advertised:  advertised,
+		subnetAddrs: append(subnetAddrs, serverSubnetAddrs...),
+		server:      server,
+	}
+	if config.MaxSessions > 0 {
+		proxy.sessions = make(chan struct{}, config.MaxSessions)
+	}
+	if config.ShadowHost != "" {
+		proxy.shadowHost = config.ShadowHost
+		if proxy.shadowAddr, err = resolveTCPAddr(config.ShadowHost); err != nil {
+			return nil, err
+		}
+	}
+	proxy.impairments = make(map[string]*impairmentSetting)
+	for _, direction := range directions {
+		proxy.impairments[direction] = newImpairmentSetting(config.Impairments[direction])
+	}
+	return proxy, nil
+}
+
+// Returns the address that a client at clientAddr should be redirected to in
+// order to reach this proxy.
+func (proxy *Proxy) redirectAddr(clientAddr net.Addr) advertisedAddr {
+	if ip := addrIP(clientAddr); ip != nil {
+		for _, addr := range proxy.subnetAddrs {
+			if addr.subnet.Contains(ip) {
+				return addr
+			}
+		}
+	}
+	return proxy.advertised
+}
+
+// Start accepting connections on the proxy's listener. When clients connect, create
+// a connection to the corresponding server and set up an InterceptService to
+// handle the communication between them.
+func (proxy *Proxy) Start() {
+	var hosts []string
+	for _, u := range proxy.upstreams {
+		hosts = append(hosts, u.host)
+	}
+	proxy.server.logger.Printf("Forwarding %s connections on %s to %s\n", proxy.serverName, proxy.host, strings.Join(hosts, ", "))
+	for {
+		conn, err := proxy.listener.AcceptTCP()
+		if err != nil {
+			select {
+			case <-proxy.server.done:
+				return
+			default:
+			}
+			proxy.server.logger.Println("Failed to accept connection: " + err.Error())
+			continue
+		}
+		proxy.server.logger.Printf("Accepted %s proxy connection on %s\n", proxy.serverName, proxy.host)
+
+		if !proxy.server.trackSession() {
+			conn.Close()
+			return
+		}
+		if !proxy.acquireSession() {
+			proxy.server.logger.Printf("Rejecting %s connection from %s; session limit reached\n",
+				proxy.serverName, conn.RemoteAddr().String())
+			conn.Close()
+			proxy.server.openSessions.Done()
+			continue
+		}
+		// Handshakes happen in the background so that a slow server can't hold up
+		// the clients behind it.
+		go func() {
+			proxy.handleConnection(conn)
+			proxy.releaseSession()
+			proxy.server.openSessions.Done()
+		}()
+	}
+}
+
+// Connects the client to the server and forwards traffic between them until
+// either side disconnects.
+func (proxy *Proxy) handleConnection(conn net.Conn) {
+	logger := proxy.server.logger
+
+	// Behind a load balancer, the client's own address comes from the header it
+	// sends ahead of the client's traffic.
+	if proxy.server.acceptProxyProtocol {
+		proxied, err := acceptProxyHeader(conn, proxy.server.handshakeTimeout)
+		if err != nil {
+			logger.Printf("Rejecting %s connection from %s: %s\n", proxy.serverName, conn.RemoteAddr().String(), err.Error())
+			conn.Close()
+			return
+		}
+		conn = proxied
+	}
+
+	// Establish a connection with one of the target PSO servers, intercepting the
+	// encryption vectors so that we can decrypt traffic.
+	serverConn, upstream, welcome, protocol, err := proxy.connectServer(conn)
+	if err != nil {
+		logger.Printf("Failed to connect to %s server: %s\n", proxy.serverName, err.Error())
+		conn.Close()
+		return
+	}
+	logger.Printf("Opened %s server connection to %s\n", proxy.serverName, upstream.host)
+	atomic.AddInt32(&upstream.sessions, 1)
+	defer atomic.AddInt32(&upstream.sessions, -1)
+
+	crypts, err := proxy.server.buildSessionCrypts(protocol, welcome)
+	if err != nil {
+		logger.Printf("Failed to set up %s encryption: %s\n", proxy.serverName, err.Error())
+		proxy.server.metrics.handshakeFailures.WithLabelValues(proxy.serverName).Inc()
+		conn.Close()
+		serverConn.Close()
+		return
+	}
+	proxy.server.debug(fmt.Sprintf("%s server speaks the %s protocol", proxy.serverName, protocol))
+	if proxy.server.keyLog != nil {
+		proxy.logKeys(protocol, crypts.clientWelcome, welcome, conn, serverConn)
+	}
+
+	activeSessions := proxy.server.metrics.activeSessions.WithLabelValues(proxy.serverName)
+	activeSessions.Inc()
+	defer activeSessions.Dec()
+
+	sessionID := atomic.AddUint64(&proxy.server.nextSessionID, 1)
+	var shadow *shadowSession
+	if proxy.shadowAddr != nil {
+		if shadow = proxy.openShadow(protocol, sessionID, conn); shadow != nil {
+			defer shadow.close()
+		}
+	}
+
+	// Decrypt and forward any data sent from the client.
+	clientInterceptor := &Interceptor{
+		ServerName: proxy.serverName,
+		Name:       "Client",
+		RecvConn:   conn,
+		RecvCrypt:  crypts.fromClient,
+		SendConn:   serverConn,
+		SendCrypt:  crypts.toServer,
+		server:     proxy.server,
+		protocol:   protocol,
+		sessionID:  sessionID,
+		sender:     newImpairedSender(proxy.impairments["Client"]),
+		shadow:     shadow,
+	}
+
+	// Decrypt and forward any data sent from the server.
+	serverInterceptor := &Interceptor{
+		ServerName: proxy.serverName,
+		Name:       "Server",
+		RecvConn:   serverConn,
+		RecvCrypt:  crypts.fromServer,
+		SendConn:   conn,
+		SendCrypt:  crypts.toClient,
+		server:     proxy.server,
+		protocol:   protocol,
+		sessionID:  sessionID,
+		sender:     newImpairedSender(proxy.impairments["Server"]),
+		shadow:     shadow,
+	}
+
+	// Give the two a clean way to stop each other when the other disconnects.
+	clientInterceptor.Partner = serverInterceptor
+	serverInterceptor.Partner = clientInterceptor
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		clientInterceptor.Start()
+		wg.Done()
+	}()
+	go func() {
+		serverInterceptor.Start()
+		wg.Done()
+	}()
+
+	// Send the encryption packet on to the client since we pulled it off the socket.
+	// If we're terminating encryption, the client gets our vectors instead.
+	welcomePacket := serverInterceptor.tag(NewWelcomePacket(proxy.serverName, welcome, time.Now()))
+	welcomePacket.sendFunc = func() {
+		err := serverInterceptor.forward(welcomePacket, crypts.clientWelcome)
+		if err != nil {
+			logger.Println("Failed to forward encryption packet; disconnecting")
+			clientInterceptor.Kill()
+			serverInterceptor.Kill()
+		}
+	}
+	proxy.server.packetChan <- welcomePacket
+
+	// Hold on to the session slot until both sides have disconnected.
+	wg.Wait()
+}
+
+// Records the session's vectors against both of its connections, since a capture
+// could have been taken on either side of the proxy.
+func (proxy *Proxy) logKeys(protocol Protocol, clientWelcome, serverWelcome []byte, conn, serverConn net.Conn) {
+	// Captures see the load balancer's address rather than the client's.
+	conn = underlyingConn(conn)
+	entries := []KeyLogEntry{
+		NewKeyLogEntry(protocol, clientWelcome, conn.RemoteAddr().String(), conn.LocalAddr().String()),
+		NewKeyLogEntry(protocol, serverWelcome, serverConn.LocalAddr().String(), serverConn.RemoteAddr().String()),
+	}
+	for _, entry := range entries {
+		if err := proxy.server.keyLog.Write(entry); err != nil {
+			proxy.server.logger.Printf("Failed to write key log: %s\n", err.Error())
+		}
+	}
+}
+
+// Reserves a slot for a new session, returning false if the proxy is at capacity.
+func (proxy *Proxy) acquireSession() bool {
+	if proxy.sessions == nil {
+		return true
+	}
+	select {
+	case proxy.sessions <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (proxy *Proxy) releaseSession() {
+	if proxy.sessions != nil {
+		<-proxy.sessions
+	}
+}
+
+func (proxy *Proxy) openSocket() error {
+	var err error
+	proxy.listener, err = net.ListenTCP("tcp", proxy.listenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to start proxy on %s; error: %s", proxy.host, err.Error())
+	}
+	return nil
+}
+
+func (proxy *Proxy) close() {
+	if proxy.listener != nil {
+		proxy.listener.Close()
+	}
+}
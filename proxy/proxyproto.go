@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProxyProtocol is a version of HAProxy's PROXY protocol, a header sent at the
+// start of a connection to pass the address of the original client along to
+// the server behind a proxy.
+type ProxyProtocol int
+
+const (
+	NoProxyProtocol ProxyProtocol = iota
+	// ProxyProtocolV1 is the human readable version.
+	ProxyProtocolV1
+	// ProxyProtocolV2 is the binary version.
+	ProxyProtocolV2
+)
+
+// ParseProxyProtocol returns the version named "v1" or "v2", or NoProxyProtocol
+// for "none" or an empty name.
+func ParseProxyProtocol(name string) (ProxyProtocol, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return NoProxyProtocol, nil
+	case "v1", "1":
+		return ProxyProtocolV1, nil
+	case "v2", "2":
+		return ProxyProtocolV2, nil
+	}
+	return NoProxyProtocol, fmt.Errorf("unknown PROXY protocol version %q", name)
+}
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// Longest v1 header allowed by the specification, including the CRLF.
+	maxProxyV1HeaderSize = 107
+	// Size of the v2 header before the addresses.
+	proxyV2HeaderSize = 16
+
+	proxyV2Local = 0x20
+	proxyV2Proxy = 0x21
+
+	proxyV2Unspec = 0x00
+	proxyV2TCP4   = 0x11
+	proxyV2TCP6   = 0x21
+)
+
+// Returns the header announcing a connection from src to dst. If either address
+// isn't TCP, such as for the proxy's own health checks, the header says so and
+// servers fall back to the address of the connection itself.
+func proxyHeader(version ProxyProtocol, src, dst net.Addr) []byte {
+	srcTCP, _ := src.(*net.TCPAddr)
+	dstTCP, _ := dst.(*net.TCPAddr)
+	known := srcTCP != nil && dstTCP != nil
+	v4 := known && srcTCP.IP.To4() != nil && dstTCP.IP.To4() != nil
+
+	if version == ProxyProtocolV1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family, srcIP, dstIP := "TCP6", srcTCP.IP.To16().String(), dstTCP.IP.To16().String()
+		if v4 {
+			family, srcIP, dstIP = "TCP4", srcTCP.IP.To4().String(), dstTCP.IP.To4().String()
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, srcTCP.Port, dstTCP.Port))
+	}
+
+	header := append([]byte(nil), proxyV2Signature...)
+	if !known {
+		return append(header, proxyV2Local, proxyV2Unspec, 0, 0)
+	}
+	var addrs []byte
+	family := byte(proxyV2TCP6)
+	if v4 {
+		family = proxyV2TCP4
+		addrs = append(append(addrs, srcTCP.IP.To4()...), dstTCP.IP.To4()...)
+	} else {
+		addrs = append(append(addrs, srcTCP.IP.To16()...), dstTCP.IP.To16()...)
+	}
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports, uint16(srcTCP.Port))
+	binary.BigEndian.PutUint16(ports[2:], uint16(dstTCP.Port))
+	addrs = append(addrs, ports...)
+
+	header = append(header, proxyV2Proxy, family, 0, 0)
+	binary.BigEndian.PutUint16(header[len(header)-2:], uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+// Sends the configured PROXY protocol header, if any, at the start of a
+// connection to a server opened on behalf of client. client is nil for
+// connections the proxy makes for itself.
+func (s *Server) sendProxyHeader(conn, client net.Conn) error {
+	if s.sendProxyProtocol == NoProxyProtocol {
+		return nil
+	}
+	var src, dst net.Addr
+	if client != nil {
+		src, dst = client.RemoteAddr(), client.LocalAddr()
+	}
+	conn.SetWriteDeadline(time.Now().Add(s.handshakeTimeout))
+	defer conn.SetWriteDeadline(time.Time{})
+	if _, err := conn.Write(proxyHeader(s.sendProxyProtocol, src, dst)); err != nil {
+		return fmt.Errorf("failed to send PROXY header: %s", err.Error())
+	}
+	return nil
+}
+
+// A connection accepted from a load balancer, reporting the addresses of the
+// client's original connection from its PROXY header.
+type proxiedConn struct {
+	net.Conn
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr { return c.remoteAddr }
+func (c *proxiedConn) LocalAddr() net.Addr  { return c.localAddr }
+
+// Returns the socket underneath any PROXY header addresses.
+func underlyingConn(conn net.Conn) net.Conn {
+	if proxied, ok := conn.(*proxiedConn); ok {
+		return proxied.Conn
+	}
+	return conn
+}
+
+// Reads the PROXY header, of either version, that a load balancer sends at the
+// start of each connection, which must arrive within timeout. Nothing past the
+// header is read, so the client's traffic is left on the connection. Headers
+// that don't carry a client address leave the connection's own in place.
+func acceptProxyHeader(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	// Both versions are at least this long.
+	buf := make([]byte, len(proxyV2Signature))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY header: %s", err.Error())
+	}
+	var src, dst net.Addr
+	var err error
+	switch {
+	case bytes.Equal(buf, proxyV2Signature):
+		src, dst, err = readProxyV2(conn)
+	case bytes.HasPrefix(buf, []byte("PROXY ")):
+		src, dst, err = readProxyV1(conn, buf)
+	default:
+		err = fmt.Errorf("connection doesn't start with a PROXY header")
+	}
+	if err != nil || src == nil {
+		return conn, err
+	}
+	return &proxiedConn{Conn: conn, remoteAddr: src, localAddr: dst}, nil
+}
+
+// Reads the rest of a v1 header one byte at a time, so as not to consume any
+// of the client's data.
+func readProxyV1(conn net.Conn, buf []byte) (net.Addr, net.Addr, error) {
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(buf, []byte("\r\n")) {
+		if len(buf) >= maxProxyV1HeaderSize {
+			return nil, nil, fmt.Errorf("PROXY header longer than %d bytes", maxProxyV1HeaderSize)
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, nil, fmt.Errorf("failed to read PROXY header: %s", err.Error())
+		}
+		buf = append(buf, b[0])
+	}
+
+	fields := strings.Fields(string(buf))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed PROXY header %q", strings.TrimSpace(string(buf)))
+	}
+	src, err := parseProxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseProxyV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q in PROXY header", host)
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q in PROXY header", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(n)}, nil
+}
+
+// Reads the rest of a v2 header following its signature. Any TLVs after the
+// addresses are skipped.
+func readProxyV2(conn net.Conn) (net.Addr, net.Addr, error) {
+	buf := make([]byte, proxyV2HeaderSize-len(proxyV2Signature))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, nil, fmt.Errorf("failed to read PROXY header: %s", err.Error())
+	}
+	command, family := buf[0], buf[1]
+	addrs := make([]byte, binary.BigEndian.Uint16(buf[2:]))
+	if _, err := io.ReadFull(conn, addrs); err != nil {
+		return nil, nil, fmt.Errorf("failed to read PROXY header: %s", err.Error())
+	}
+	if command&0xF0 != 0x20 {
+		return nil, nil, fmt.Errorf("unsupported PROXY header version %d", command>>4)
+	}
+	if command == proxyV2Local {
+		return nil, nil, nil
+	}
+
+	ipSize := 0
+	switch family {
+	case proxyV2TCP4:
+		ipSize = net.IPv4len
+	case proxyV2TCP6:
+		ipSize = net.IPv6len
+	default:
+		// Not a TCP connection, so there's no client address to use.
+		return nil, nil, nil
+	}
+	if len(addrs) < 2*ipSize+4 {
+		return nil, nil, fmt.Errorf("PROXY header too short for its addresses")
+	}
+	src := &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), addrs[:ipSize]...)),
+		Port: int(binary.BigEndian.Uint16(addrs[2*ipSize:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), addrs[ipSize:2*ipSize]...)),
+		Port: int(binary.BigEndian.Uint16(addrs[2*ipSize+2:])),
+	}
+	return src, dst, nil
+}
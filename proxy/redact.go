@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Byte written over redacted fields; shows up as '*' in hex dumps.
+const redactionMask = '*'
+
+// RedactedField is a sensitive field at a fixed position in a BB packet.
+type RedactedField struct {
+	Name     string
+	Command  uint16
+	FromName string
+	Offset   int
+	Length   int
+}
+
+// DefaultRedactedFields returns the credentials and client identifiers sent
+// during login, which shouldn't end up in logs that get shared.
+func DefaultRedactedFields() []RedactedField {
+	return []RedactedField{
+		{Name: "username", Command: 0x93, FromName: "Client", Offset: 0x1C, Length: 0x30},
+		{Name: "password", Command: 0x93, FromName: "Client", Offset: 0x4C, Length: 0x30},
+		{Name: "hwid", Command: 0x93, FromName: "Client", Offset: 0x84, Length: 0x08},
+		{Name: "security", Command: 0x93, FromName: "Client", Offset: 0x8C, Length: 0x28},
+		{Name: "security", Command: 0xE6, FromName: "Server", Offset: 0x18, Length: 0x28},
+	}
+}
+
+// ErrNoRedactedFields is returned by RedactedFieldsNamed when no names are given.
+// Leaving Config.RedactedFields empty masks every field, so turning redaction
+// off is done with Config.DisableRedaction instead.
+var ErrNoRedactedFields = errors.New("no redacted fields named")
+
+// RedactedFieldsNamed returns the default fields with the given names, or all
+// of them for "all". Empty names are skipped.
+func RedactedFieldsNamed(names []string) ([]RedactedField, error) {
+	var fields []RedactedField
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, field := range DefaultRedactedFields() {
+			if name == "all" || field.Name == name {
+				fields = append(fields, field)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown redacted field %q", name)
+		}
+	}
+	if len(fields) == 0 {
+		return nil, ErrNoRedactedFields
+	}
+	return fields, nil
+}
+
+// Redactor masks sensitive fields in the copies of packets handed to sinks.
+type Redactor struct {
+	fields map[uint16][]RedactedField
+}
+
+// NewRedactor returns a Redactor that masks fields.
+func NewRedactor(fields []RedactedField) *Redactor {
+	r := &Redactor{fields: make(map[uint16][]RedactedField)}
+	for _, field := range fields {
+		r.fields[field.Command] = append(r.fields[field.Command], field)
+	}
+	return r
+}
+
+// Redact returns a copy of packet with its sensitive fields masked in both the
+// raw and decrypted data, or packet itself if it has none. A nil Redactor
+// leaves every packet alone.
+func (r *Redactor) Redact(packet *PacketMsg) *PacketMsg {
+	if r == nil || packet.Protocol != ProtocolBB {
+		return packet
+	}
+	// Shadow servers send the same fields as the primary.
+	fromName := packet.FromName
+	if fromName == ShadowName {
+		fromName = "Server"
+	}
+	var redacted *PacketMsg
+	for _, field := range r.fields[packet.Command] {
+		if field.FromName != fromName {
+			continue
+		}
+		if redacted == nil {
+			copied := *packet
+			copied.Data = append([]byte(nil), packet.Data...)
+			copied.DecryptedData = append([]byte(nil), packet.DecryptedData...)
+			redacted = &copied
+		}
+		mask(redacted.Data, field.Offset, field.Length)
+		mask(redacted.DecryptedData, field.Offset, field.Length)
+	}
+	if redacted == nil {
+		return packet
+	}
+	return redacted
+}
+
+func mask(data []byte, offset, length int) {
+	for i := offset; i < offset+length && i < len(data); i++ {
+		data[i] = redactionMask
+	}
+}
@@ -0,0 +1,383 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RequestPair is a client request that the server is expected to answer with
+// one of Responses.
+type RequestPair struct {
+	Request   uint16
+	Responses []uint16
+}
+
+// RequestPairs are the known request/response exchanges of the BB protocol.
+var RequestPairs = []RequestPair{
+	{Request: 0x93, Responses: []uint16{0xE6}},
+	{Request: 0xE0, Responses: []uint16{0xE2}},
+	{Request: 0xE3, Responses: []uint16{0xE5, 0xE4}},
+	{Request: 0x01E8, Responses: []uint16{0x02E8}},
+	{Request: 0x03E8, Responses: []uint16{0x01DC}},
+	{Request: 0x03DC, Responses: []uint16{0x02DC}},
+	{Request: 0x04EB, Responses: []uint16{0x01EB}},
+	{Request: 0x03EB, Responses: []uint16{0x02EB}},
+}
+
+const (
+	// Number of recent exchanges kept for Exchanges.
+	recentExchanges = 100
+	// Number of response times sampled per request command for the median and
+	// 95th percentile.
+	maxResponseTimes = 1000
+	// Requests still pending in sessions that haven't sent a packet for this long
+	// are forgotten, since the session has most likely ended.
+	sessionIdleTimeout = time.Minute
+)
+
+// Exchange is a request paired with the server's response to it. Response is 0
+// and Elapsed the timeout if no response arrived in time.
+type Exchange struct {
+	SessionID uint64
+	Server    string
+	Request   uint16
+	Response  uint16
+	Sent      time.Time
+	Elapsed   time.Duration
+}
+
+// ResponseStats summarizes the server's response times to one request command.
+type ResponseStats struct {
+	Server   string
+	Request  uint16
+	Replies  int
+	TimedOut int
+	Min      time.Duration
+	Mean     time.Duration
+	Median   time.Duration
+	P95      time.Duration
+	Max      time.Duration
+}
+
+// Key for the statistics of one request command.
+type requestKey struct {
+	server  string
+	request uint16
+}
+
+// Response times of one request command. The count, total, minimum and maximum
+// cover every response, while the sample holds a uniformly random selection of
+// at most maxResponseTimes of them.
+type responseTimes struct {
+	count    int
+	total    time.Duration
+	min, max time.Duration
+	sample   []time.Duration
+}
+
+func (rt *responseTimes) add(d time.Duration) {
+	rt.count++
+	rt.total += d
+	if rt.count == 1 || d < rt.min {
+		rt.min = d
+	}
+	if d > rt.max {
+		rt.max = d
+	}
+	if len(rt.sample) < maxResponseTimes {
+		rt.sample = append(rt.sample, d)
+	} else if n := rand.Intn(rt.count); n < maxResponseTimes {
+		rt.sample[n] = d
+	}
+}
+
+// ResponseTracker is a Sink that pairs the requests in RequestPairs with their
+// responses within each session, keeping statistics of the server's response
+// times and logging a warning for requests left unanswered for longer than
+// Timeout. Time is measured with the packets' timestamps, so that captures can
+// be analyzed as well as live traffic.
+type ResponseTracker struct {
+	Logger  *log.Logger
+	Timeout time.Duration
+
+	mu    sync.Mutex
+	pairs map[uint16][]uint16
+	// Requests awaiting a response in each session, oldest first.
+	pending map[uint64][]*Exchange
+	// Time of the latest packet in each session with pending requests.
+	lastSeen map[uint64]time.Time
+	times    map[requestKey]*responseTimes
+	expired  map[requestKey]int
+	recent   []Exchange
+}
+
+// NewResponseTracker returns a ResponseTracker that warns on logger about
+// requests unanswered after timeout.
+func NewResponseTracker(logger *log.Logger, timeout time.Duration) *ResponseTracker {
+	t := &ResponseTracker{
+		Logger:   logger,
+		Timeout:  timeout,
+		pairs:    make(map[uint16][]uint16),
+		pending:  make(map[uint64][]*Exchange),
+		lastSeen: make(map[uint64]time.Time),
+		times:    make(map[requestKey]*responseTimes),
+		expired:  make(map[requestKey]int),
+	}
+	for _, pair := range RequestPairs {
+		t.pairs[pair.Request] = pair.Responses
+	}
+	return t
+}
+
+// WritePacket records requests and pairs responses with the oldest request in
+// the session that they answer.
+func (t *ResponseTracker) WritePacket(packet *PacketMsg) {
+	if packet.Err != nil || packet.Protocol != ProtocolBB {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire(packet.Timestamp)
+	if _, ok := t.pending[packet.SessionID]; ok {
+		t.lastSeen[packet.SessionID] = packet.Timestamp
+	}
+
+	if packet.FromName == "Client" {
+		if _, ok := t.pairs[packet.Command]; ok {
+			t.pending[packet.SessionID] = append(t.pending[packet.SessionID], &Exchange{
+				SessionID: packet.SessionID,
+				Server:    packet.Server,
+				Request:   packet.Command,
+				Sent:      packet.Timestamp,
+			})
+			t.lastSeen[packet.SessionID] = packet.Timestamp
+		}
+		return
+	} else if packet.FromName != "Server" {
+		return
+	}
+
+	pending := t.pending[packet.SessionID]
+	for n, exchange := range pending {
+		if !containsCommand(t.pairs[exchange.Request], packet.Command) {
+			continue
+		}
+		exchange.Response = packet.Command
+		exchange.Elapsed = packet.Timestamp.Sub(exchange.Sent)
+		key := requestKey{exchange.Server, exchange.Request}
+		if t.times[key] == nil {
+			t.times[key] = &responseTimes{}
+		}
+		t.times[key].add(exchange.Elapsed)
+		t.record(*exchange)
+		t.setPending(packet.SessionID, append(pending[:n], pending[n+1:]...))
+		return
+	}
+}
+
+// Expire warns about the requests that have gone unanswered for longer than the
+// timeout as of now and forgets those of sessions that have gone quiet. It only
+// needs to be called when no packets are coming in to move the clock on, such as
+// periodically while the proxy is running.
+func (t *ResponseTracker) Expire(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire(now)
+}
+
+func (t *ResponseTracker) expire(now time.Time) {
+	for sessionID, pending := range t.pending {
+		if now.Sub(t.lastSeen[sessionID]) > sessionIdleTimeout {
+			t.setPending(sessionID, nil)
+			continue
+		}
+		if t.Timeout <= 0 {
+			continue
+		}
+		remaining := pending[:0]
+		for _, exchange := range pending {
+			if now.Sub(exchange.Sent) <= t.Timeout {
+				remaining = append(remaining, exchange)
+				continue
+			}
+			exchange.Elapsed = t.Timeout
+			t.expired[requestKey{exchange.Server, exchange.Request}]++
+			t.record(*exchange)
+			t.Logger.Printf("WARN: %s %s request in session %d got no response within %s\n",
+				exchange.Server, commandName(exchange.Server, exchange.Request), sessionID, t.Timeout)
+		}
+		t.setPending(sessionID, remaining)
+	}
+}
+
+func (t *ResponseTracker) setPending(sessionID uint64, pending []*Exchange) {
+	if len(pending) == 0 {
+		delete(t.pending, sessionID)
+		delete(t.lastSeen, sessionID)
+	} else {
+		t.pending[sessionID] = pending
+	}
+}
+
+func (t *ResponseTracker) record(exchange Exchange) {
+	t.recent = append(t.recent, exchange)
+	if len(t.recent) > recentExchanges {
+		t.recent = t.recent[len(t.recent)-recentExchanges:]
+	}
+}
+
+// Exchanges returns the most recently completed or timed out exchanges, oldest
+// first.
+func (t *ResponseTracker) Exchanges() []Exchange {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Exchange(nil), t.recent...)
+}
+
+// Stats returns the response time statistics of every request seen, ordered by
+// server and command.
+func (t *ResponseTracker) Stats() []ResponseStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	keys := make(map[requestKey]bool)
+	for key := range t.times {
+		keys[key] = true
+	}
+	for key := range t.expired {
+		keys[key] = true
+	}
+	var stats []ResponseStats
+	for key := range keys {
+		s := ResponseStats{
+			Server:   key.server,
+			Request:  key.request,
+			TimedOut: t.expired[key],
+		}
+		if rt := t.times[key]; rt != nil {
+			times := append([]time.Duration(nil), rt.sample...)
+			sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+			s.Replies = rt.count
+			s.Min, s.Max = rt.min, rt.max
+			s.Mean = rt.total / time.Duration(rt.count)
+			s.Median = times[len(times)/2]
+			s.P95 = times[len(times)*95/100]
+		}
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Server != stats[j].Server {
+			return stats[i].Server < stats[j].Server
+		}
+		return stats[i].Request < stats[j].Request
+	})
+	return stats
+}
+
+// WriteReport writes the response time statistics to w as a table.
+func (t *ResponseTracker) WriteReport(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "%-10s %-36s %7s %8s %10s %10s %10s %10s %10s\n",
+		"SERVER", "REQUEST", "REPLIES", "TIMEOUTS", "MIN", "MEAN", "MEDIAN", "P95", "MAX")
+	if err != nil {
+		return err
+	}
+	for _, s := range t.Stats() {
+		times := []interface{}{"-", "-", "-", "-", "-"}
+		if s.Replies > 0 {
+			for n, d := range []time.Duration{s.Min, s.Mean, s.Median, s.P95, s.Max} {
+				times[n] = roundDuration(d)
+			}
+		}
+		_, err := fmt.Fprintf(w, "%-10s %-36s %7d %8d %10s %10s %10s %10s %10s\n",
+			append([]interface{}{s.Server, commandName(s.Server, s.Request), s.Replies, s.TimedOut}, times...)...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type responseStatsJSON struct {
+	Server   string `json:"server"`
+	Request  string `json:"request"`
+	Replies  int    `json:"replies"`
+	TimedOut int    `json:"timed_out"`
+	Min      string `json:"min"`
+	Mean     string `json:"mean"`
+	Median   string `json:"median"`
+	P95      string `json:"p95"`
+	Max      string `json:"max"`
+}
+
+type exchangeJSON struct {
+	Session  uint64    `json:"session"`
+	Server   string    `json:"server"`
+	Request  string    `json:"request"`
+	Response string    `json:"response,omitempty"`
+	Sent     time.Time `json:"sent"`
+	Elapsed  string    `json:"elapsed"`
+}
+
+// ServeHTTP responds with the statistics and recent exchanges as JSON.
+func (t *ResponseTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	stats := []responseStatsJSON{}
+	for _, s := range t.Stats() {
+		stats = append(stats, responseStatsJSON{
+			Server:   s.Server,
+			Request:  commandName(s.Server, s.Request),
+			Replies:  s.Replies,
+			TimedOut: s.TimedOut,
+			Min:      roundDuration(s.Min).String(),
+			Mean:     roundDuration(s.Mean).String(),
+			Median:   roundDuration(s.Median).String(),
+			P95:      roundDuration(s.P95).String(),
+			Max:      roundDuration(s.Max).String(),
+		})
+	}
+	exchanges := []exchangeJSON{}
+	for _, e := range t.Exchanges() {
+		exchange := exchangeJSON{
+			Session: e.SessionID,
+			Server:  e.Server,
+			Request: commandName(e.Server, e.Request),
+			Sent:    e.Sent,
+			Elapsed: roundDuration(e.Elapsed).String(),
+		}
+		if e.Response != 0 {
+			exchange.Response = commandName(e.Server, e.Response)
+		}
+		exchanges = append(exchanges, exchange)
+	}
+	writeJSON(w, struct {
+		Stats     []responseStatsJSON `json:"stats"`
+		Exchanges []exchangeJSON      `json:"exchanges"`
+	}{stats, exchanges})
+}
+
+func containsCommand(commands []uint16, command uint16) bool {
+	for _, c := range commands {
+		if c == command {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the packet's name followed by its command, or just the command if it
+// has no name.
+func commandName(server string, command uint16) string {
+	if name := PacketName(server, command); name != "" {
+		return fmt.Sprintf("%s (%04x)", name, command)
+	}
+	return fmt.Sprintf("%04x", command)
+}
+
+func roundDuration(d time.Duration) time.Duration {
+	return d.Round(10 * time.Microsecond)
+}
@@ -0,0 +1,369 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dcrodman/archon/util"
+	crypto "github.com/dcrodman/bb_reverse_proxy/encryption"
+)
+
+// Crypt encrypts and decrypts packet data in place for one direction of a session.
+type Crypt interface {
+	Encrypt(data []byte, size uint32)
+	Decrypt(data []byte, size uint32)
+}
+
+// CryptBuilder creates the ciphers for the client and server sides of a session
+// from the welcome packet sent by the server.
+type CryptBuilder func(protocol Protocol, welcome []byte) (clientCrypt Crypt, serverCrypt Crypt, err error)
+
+// Hook is called with every packet read by an Interceptor before it is handed
+// to the sinks and forwarded. Hooks may modify the packet's decrypted data; unless
+// encryption is terminated at the proxy they must do so in place and also update
+// Data, since the original bytes are what get forwarded.
+type Hook func(packet *PacketMsg)
+
+// ProxyConfig describes one listening port and the server it forwards to.
+type ProxyConfig struct {
+	ServerName string
+	Host       string
+	RemoteHost string
+	// Servers to balance sessions across instead of RemoteHost, failing over to
+	// the next when one can't be reached.
+	RemoteHosts []string
+
+	// Overrides for the Config values of the same names when clients are
+	// redirected to this proxy.
+	AdvertisedHost    string
+	AdvertisedSubnets []SubnetAddress
+	// Overrides Config.MaxSessions for this proxy.
+	MaxSessions int
+	// Overrides Config.Impairments for this proxy.
+	Impairments map[string]Impairment
+	// Secondary server to which every session's client packets are also sent, so
+	// that its responses can be compared with RemoteHost's. They're passed to the
+	// sinks as ShadowName packets but never reach the client.
+	ShadowHost string
+
+	// Set from Config.
+	Balancing Balancing
+}
+
+// Config contains everything needed to set up a Server.
+type Config struct {
+	// Host on which the proxy will listen; may be a hostname or IPv6 address.
+	Host string
+	// Address injected into redirect packets so that clients reconnect to the
+	// proxy. Must resolve to an IPv4 address. Defaults to Host.
+	AdvertisedHost string
+	// Addresses to advertise to clients on specific networks, checked in order
+	// after those of the individual proxy.
+	AdvertisedSubnets []SubnetAddress
+	Proxies           []ProxyConfig
+
+	// Destinations for intercepted packets. Defaults to a LogSink on Logger.
+	Sinks []Sink
+	// Fields masked in the packets given to sinks; the original bytes are still
+	// forwarded. Defaults to DefaultRedactedFields() unless DisableRedaction is set.
+	RedactedFields   []RedactedField
+	DisableRedaction bool
+	Hooks            []Hook
+	// Defaults to BuildCrypts.
+	CryptBuilder CryptBuilder
+	// Decrypt and re-encrypt every packet with vectors of the proxy's own on the
+	// client side, so that hooks are free to change the size of packets.
+	TerminateEncryption bool
+	// How long to wait for the server's welcome packet. Defaults to 10 seconds.
+	HandshakeTimeout time.Duration
+	// How long to wait for each attempt to connect to a server. Defaults to 5 seconds.
+	DialTimeout time.Duration
+	// Number of times to retry connecting to a server before giving up on the
+	// client, waiting DialBackoff (default half a second) before the first retry
+	// and doubling it each time after.
+	DialRetries int
+	DialBackoff time.Duration
+	// Maximum number of concurrent sessions per proxy; 0 means no limit.
+	MaxSessions int
+	// How sessions are spread across proxies with several RemoteHosts, whose
+	// servers are connected to every HealthCheckInterval (default 10 seconds) to
+	// check that they're up.
+	Balancing           Balancing
+	HealthCheckInterval time.Duration
+	// PROXY protocol header to send at the start of every connection to a server,
+	// so that it sees the address of the client instead of the proxy.
+	SendProxyProtocol ProxyProtocol
+	// Expect a PROXY protocol header, of either version, at the start of every
+	// client connection, as sent by a load balancer in front of the proxy, and
+	// treat the client as connecting from the address it gives.
+	AcceptProxyProtocol bool
+	// Network conditions to simulate on every proxy, keyed by the side the
+	// packets come from ("Client" or "Server"). They can be changed while the
+	// Server runs with SetImpairment.
+	Impairments map[string]Impairment
+
+	// If set, the encryption vectors of every connection are written here so
+	// that captures taken elsewhere can be decrypted.
+	KeyLog io.Writer
+
+	// Used for connection status messages. Defaults to stderr.
+	Logger *log.Logger
+	// Verbose logging for dev.
+	Debug bool
+}
+
+// DefaultProxies returns the standard set of PSOBB server ports, listening on host
+// and forwarding to the same server port plus ten on serverHost.
+func DefaultProxies(host, serverHost string) []ProxyConfig {
+	return []ProxyConfig{
+		{ServerName: "LOGIN", Host: net.JoinHostPort(host, "12000"), RemoteHost: net.JoinHostPort(serverHost, "12010")},
+		{ServerName: "CHARACTER", Host: net.JoinHostPort(host, "12001"), RemoteHost: net.JoinHostPort(serverHost, "12011")},
+		{ServerName: "SHIP", Host: net.JoinHostPort(host, "15000"), RemoteHost: net.JoinHostPort(serverHost, "15010")},
+		{ServerName: "BLOCK1", Host: net.JoinHostPort(host, "15001"), RemoteHost: net.JoinHostPort(serverHost, "15011")},
+		{ServerName: "BLOCK2", Host: net.JoinHostPort(host, "15002"), RemoteHost: net.JoinHostPort(serverHost, "15012")},
+	}
+}
+
+// Server runs a set of Proxy instances and funnels all of the traffic they
+// intercept through its sinks.
+type Server struct {
+	proxies             []*Proxy
+	sinks               []Sink
+	redactor            *Redactor
+	debugger            *debugger
+	hooks               []Hook
+	cryptBuilder        CryptBuilder
+	terminateEncryption bool
+	handshakeTimeout    time.Duration
+	dialTimeout         time.Duration
+	dialRetries         int
+	dialBackoff         time.Duration
+	healthCheckInterval time.Duration
+	sendProxyProtocol   ProxyProtocol
+	acceptProxyProtocol bool
+	keyLog              *KeyLogWriter
+	logger              *log.Logger
+	debugMode           bool
+
+	packetChan   chan *PacketMsg
+	metrics      *metrics
+	shadowReport shadowReport
+	// Used for ordered printing of debug messages.
+	debugChan chan string
+
+	done     chan struct{}
+	stopOnce sync.Once
+	// Counts the sessions, and the goroutines of their shadows, that may still
+	// send packets. Guarded by stopMu so that none are added once stopped.
+	openSessions sync.WaitGroup
+	stopMu       sync.Mutex
+	// Incremented atomically as each session is set up.
+	nextSessionID uint64
+}
+
+// NewServer returns a Server configured according to config. No sockets are
+// opened until Start is called.
+func NewServer(config Config) (*Server, error) {
+	s := &Server{
+		sinks:               config.Sinks,
+		hooks:               config.Hooks,
+		debugger:            newDebugger(),
+		cryptBuilder:        config.CryptBuilder,
+		terminateEncryption: config.TerminateEncryption,
+		handshakeTimeout:    config.HandshakeTimeout,
+		dialTimeout:         config.DialTimeout,
+		dialRetries:         config.DialRetries,
+		dialBackoff:         config.DialBackoff,
+		healthCheckInterval: config.HealthCheckInterval,
+		sendProxyProtocol:   config.SendProxyProtocol,
+		acceptProxyProtocol: config.AcceptProxyProtocol,
+		logger:              config.Logger,
+		debugMode:           config.Debug,
+		packetChan:          make(chan *PacketMsg, 500),
+		debugChan:           make(chan string, 100),
+		done:                make(chan struct{}),
+	}
+	s.metrics = newMetrics(s)
+	if config.KeyLog != nil {
+		s.keyLog = NewKeyLogWriter(config.KeyLog)
+	}
+	if s.logger == nil {
+		s.logger = log.New(os.Stderr, "", log.Ltime)
+	}
+	if len(s.sinks) == 0 {
+		s.sinks = []Sink{NewLogSink(s.logger, false)}
+	}
+	if !config.DisableRedaction {
+		if config.RedactedFields == nil {
+			config.RedactedFields = DefaultRedactedFields()
+		}
+		s.redactor = NewRedactor(config.RedactedFields)
+	}
+	if s.cryptBuilder == nil {
+		s.cryptBuilder = BuildCrypts
+	}
+	if s.handshakeTimeout == 0 {
+		s.handshakeTimeout = defaultHandshakeTimeout
+	}
+	if s.dialTimeout == 0 {
+		s.dialTimeout = 5 * time.Second
+	}
+	if s.dialBackoff == 0 {
+		s.dialBackoff = 500 * time.Millisecond
+	}
+	if s.healthCheckInterval == 0 {
+		s.healthCheckInterval = defaultHealthCheckInterval
+	}
+
+	if config.AdvertisedHost == "" {
+		config.AdvertisedHost = config.Host
+	}
+	subnetAddrs, err := resolveSubnetAddresses(config.AdvertisedSubnets)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pc := range config.Proxies {
+		if pc.AdvertisedHost == "" {
+			pc.AdvertisedHost = config.AdvertisedHost
+		}
+		if pc.MaxSessions == 0 {
+			pc.MaxSessions = config.MaxSessions
+		}
+		pc.Balancing = config.Balancing
+		for direction, imp := range config.Impairments {
+			if _, ok := pc.Impairments[direction]; !ok {
+				if pc.Impairments == nil {
+					pc.Impairments = make(map[string]Impairment)
+				}
+				pc.Impairments[direction] = imp
+			}
+		}
+		proxy, err := newProxy(s, pc, subnetAddrs)
+		if err != nil {
+			return nil, fmt.Errorf("%s proxy: %s", pc.ServerName, err.Error())
+		}
+		s.proxies = append(s.proxies, proxy)
+	}
+	return s, nil
+}
+
+// Start opens the listening sockets for every configured Proxy and begins
+// forwarding traffic in the background.
+func (s *Server) Start() error {
+	for _, proxy := range s.proxies {
+		if err := proxy.openSocket(); err != nil {
+			s.Stop()
+			return err
+		}
+	}
+	for _, proxy := range s.proxies {
+		go proxy.Start()
+		if len(proxy.upstreams) > 1 {
+			go proxy.checkHealth(s.healthCheckInterval)
+		}
+	}
+
+	if s.debugMode {
+		go s.logDebugMessages()
+	}
+	go s.consumePackets()
+	return nil
+}
+
+// ListenAndServe starts the Server and blocks until it is stopped.
+func (s *Server) ListenAndServe() error {
+	if err := s.Start(); err != nil {
+		return err
+	}
+	<-s.done
+	return nil
+}
+
+// Stop closes all of the listening sockets. Sessions that are already
+// established are left to finish on their own, with their packets still
+// handed to the sinks and forwarded.
+func (s *Server) Stop() {
+	s.stopOnce.Do(func() {
+		s.stopMu.Lock()
+		close(s.done)
+		s.stopMu.Unlock()
+		for _, proxy := range s.proxies {
+			proxy.close()
+		}
+	})
+}
+
+// Registers something that will send to packetChan, returning false if the
+// Server has been stopped. Each successful call must be matched by a call to
+// openSessions.Done.
+func (s *Server) trackSession() bool {
+	s.stopMu.Lock()
+	defer s.stopMu.Unlock()
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+	s.openSessions.Add(1)
+	return true
+}
+
+// BuildCrypts creates the client and server ciphers from the vectors in a
+// BB or patch server welcome packet.
+func BuildCrypts(protocol Protocol, buf []byte) (Crypt, Crypt, error) {
+	switch protocol {
+	case ProtocolBB:
+		var welcomePkt WelcomePkt
+		util.StructFromBytes(buf, &welcomePkt)
+		cCrypt := crypto.NewBBCrypt(welcomePkt.ClientVector)
+		sCrypt := crypto.NewBBCrypt(welcomePkt.ServerVector)
+		return cCrypt, sCrypt, nil
+	case ProtocolPatch:
+		var welcomePkt PatchWelcomePkt
+		util.StructFromBytes(buf, &welcomePkt)
+		cCrypt := crypto.NewPCCrypt(welcomePkt.ClientVector)
+		sCrypt := crypto.NewPCCrypt(welcomePkt.ServerVector)
+		return cCrypt, sCrypt, nil
+	}
+	return nil, nil, fmt.Errorf("no ciphers for protocol %s", protocol)
+}
+
+// Takes the port provided by the server for a redirect and returns the corresponding
+// proxy set up to capture traffic, or nil if there isn't one.
+func (s *Server) getProxy(serverPort uint16) *Proxy {
+	for _, proxy := range s.proxies {
+		for _, u := range proxy.upstreams {
+			if u.addr.Port == int(serverPort) {
+				return proxy
+			}
+		}
+	}
+	s.logger.Printf("WARN: Port mappings misconfigured; no proxy port for %d\n", serverPort)
+	return nil
+}
+
+func (s *Server) debug(message string) {
+	if s.debugMode {
+		select {
+		case s.debugChan <- message:
+		case <-s.done:
+		}
+	}
+}
+
+func (s *Server) logDebugMessages() {
+	for {
+		select {
+		case message := <-s.debugChan:
+			s.logger.Printf("%s\n", message)
+		case <-s.done:
+			return
+		}
+	}
+}
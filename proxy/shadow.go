@@ -0,0 +1,319 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ShadowName is the FromName of the packets sent by shadow servers, which are
+// handed to the sinks alongside the rest of the session's traffic but never
+// forwarded to the client.
+const ShadowName = "Shadow"
+
+const (
+	// Client packets waiting to be sent to a shadow server. A shadow that falls
+	// this far behind is disconnected rather than hold up the client.
+	shadowQueueSize = 500
+	// Differences closer together than this are reported as one field.
+	shadowFieldGap = 4
+)
+
+// ShadowDiff summarizes how a shadow server's responses of one command compare
+// with those of the primary server.
+type ShadowDiff struct {
+	Server  string
+	Command uint16
+	// Responses seen from both servers and how many of those differed.
+	Compared  int
+	Differing int
+	// Responses of a different size.
+	SizeMismatches int
+	// Responses sent by only the primary or only the shadow.
+	Missing int
+	Extra   int
+	// How often each range of bytes, such as "0x0010-0x0013", differed.
+	Fields map[string]int
+}
+
+// Collects the ShadowDiffs of a Server.
+type shadowReport struct {
+	mu    sync.Mutex
+	diffs map[requestKey]*ShadowDiff
+}
+
+func (r *shadowReport) diff(server string, command uint16) *ShadowDiff {
+	key := requestKey{server, command}
+	if r.diffs == nil {
+		r.diffs = make(map[requestKey]*ShadowDiff)
+	}
+	diff := r.diffs[key]
+	if diff == nil {
+		diff = &ShadowDiff{Server: server, Command: command, Fields: make(map[string]int)}
+		r.diffs[key] = diff
+	}
+	return diff
+}
+
+// ShadowReport returns how the responses of the shadow servers have differed
+// from those of the primary servers, ordered by server and command.
+func (s *Server) ShadowReport() []ShadowDiff {
+	r := &s.shadowReport
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var diffs []ShadowDiff
+	for _, diff := range r.diffs {
+		copied := *diff
+		copied.Fields = make(map[string]int)
+		for field, count := range diff.Fields {
+			copied.Fields[field] = count
+		}
+		diffs = append(diffs, copied)
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		if diffs[i].Server != diffs[j].Server {
+			return diffs[i].Server < diffs[j].Server
+		}
+		return diffs[i].Command < diffs[j].Command
+	})
+	return diffs
+}
+
+// The connection to the shadow server for one session. Client packets are
+// re-encrypted with the shadow's own vectors, and its responses are matched up
+// with the primary's by command in the order they arrive.
+type shadowSession struct {
+	server     *Server
+	serverName string
+	sessionID  uint64
+	clientAddr string
+	conn       net.Conn
+	toShadow   Crypt
+	decoder    *StreamDecoder
+	headerSize uint16
+	queue      chan []byte
+	closeOnce  sync.Once
+	// Set once the shadow has been given up on.
+	stopped int32
+
+	mu sync.Mutex
+	// Responses of each command waiting for their counterpart from the other
+	// server, oldest first.
+	primary map[uint16][]*PacketMsg
+	shadow  map[uint16][]*PacketMsg
+}
+
+// Connects to the proxy's shadow server for a session of client speaking
+// protocol. Nothing that goes wrong with the shadow is allowed to affect the
+// client, so failures are only logged.
+func (proxy *Proxy) openShadow(protocol Protocol, sessionID uint64, client net.Conn) *shadowSession {
+	s := proxy.server
+	conn, err := net.DialTimeout("tcp", proxy.shadowAddr.String(), s.dialTimeout)
+	if err != nil {
+		s.logger.Printf("Failed to connect to %s shadow server: %s\n", proxy.serverName, err.Error())
+		return nil
+	}
+	err = s.sendProxyHeader(conn, client)
+	var welcome []byte
+	var shadowProtocol Protocol
+	if err == nil {
+		welcome, shadowProtocol, err = readWelcome(conn, s.handshakeTimeout)
+	}
+	if err == nil && shadowProtocol != protocol {
+		err = fmt.Errorf("speaks %s instead of %s", shadowProtocol, protocol)
+	}
+	var clientCrypt, serverCrypt Crypt
+	if err == nil {
+		clientCrypt, serverCrypt, err = s.cryptBuilder(protocol, welcome)
+	}
+	if err != nil {
+		s.logger.Printf("%s shadow handshake with %s failed: %s\n", proxy.serverName, proxy.shadowHost, err.Error())
+		conn.Close()
+		return nil
+	}
+
+	shadow := &shadowSession{
+		server:     s,
+		serverName: proxy.serverName,
+		sessionID:  sessionID,
+		clientAddr: client.RemoteAddr().String(),
+		conn:       conn,
+		toShadow:   clientCrypt,
+		decoder:    NewStreamDecoder(proxy.serverName, ShadowName, protocol, serverCrypt),
+		headerSize: protocol.headerSize(),
+		queue:      make(chan []byte, shadowQueueSize),
+		primary:    make(map[uint16][]*PacketMsg),
+		shadow:     make(map[uint16][]*PacketMsg),
+	}
+	// The reader hands packets to the Server, so it has to be tracked like a
+	// session in case it outlives its own.
+	if !s.trackSession() {
+		conn.Close()
+		return nil
+	}
+	go shadow.writePackets()
+	go func() {
+		shadow.readPackets()
+		s.openSessions.Done()
+	}()
+	return shadow
+}
+
+// Queues a copy of a client packet to be sent to the shadow server.
+func (shadow *shadowSession) forward(packet *PacketMsg) {
+	if atomic.LoadInt32(&shadow.stopped) > 0 {
+		return
+	}
+	data := append([]byte(nil), packet.DecryptedData...)
+	for len(data)%int(shadow.headerSize) != 0 {
+		data = append(data, 0)
+	}
+	select {
+	case shadow.queue <- data:
+	default:
+		shadow.server.logger.Printf("%s shadow server fell behind; disconnecting it\n", shadow.serverName)
+		shadow.stop()
+	}
+}
+
+func (shadow *shadowSession) writePackets() {
+	for data := range shadow.queue {
+		shadow.toShadow.Encrypt(data, uint32(len(data)))
+		if _, err := shadow.conn.Write(data); err != nil {
+			shadow.stop()
+			return
+		}
+	}
+}
+
+func (shadow *shadowSession) readPackets() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := shadow.conn.Read(buf)
+		if err != nil {
+			shadow.stop()
+			return
+		}
+		packets, err := shadow.decoder.Write(buf[:n], time.Now())
+		for _, packet := range packets {
+			packet.SessionID = shadow.sessionID
+			packet.ClientAddr = shadow.clientAddr
+			shadow.compare(packet, ShadowName)
+			shadow.server.packetChan <- packet
+		}
+		if err != nil {
+			shadow.server.logger.Printf("Desync reading from %s shadow server: %s\n", shadow.serverName, err.Error())
+			shadow.stop()
+			return
+		}
+	}
+}
+
+// Matches a response from either server with the oldest of the same command
+// from the other one and records any differences.
+func (shadow *shadowSession) compare(packet *PacketMsg, fromName string) {
+	packet = &PacketMsg{Command: packet.Command, DecryptedData: append([]byte(nil), packet.DecryptedData...)}
+	shadow.mu.Lock()
+	waiting, other := shadow.primary, shadow.shadow
+	if fromName == ShadowName {
+		waiting, other = shadow.shadow, shadow.primary
+	}
+	if len(other[packet.Command]) == 0 {
+		waiting[packet.Command] = append(waiting[packet.Command], packet)
+		shadow.mu.Unlock()
+		return
+	}
+	counterpart := other[packet.Command][0]
+	other[packet.Command] = other[packet.Command][1:]
+	shadow.mu.Unlock()
+
+	primary, shadowed := counterpart, packet
+	if fromName != ShadowName {
+		primary, shadowed = packet, counterpart
+	}
+	fields := differingFields(primary.DecryptedData, shadowed.DecryptedData)
+	sizeMismatch := len(primary.DecryptedData) != len(shadowed.DecryptedData)
+
+	r := &shadow.server.shadowReport
+	r.mu.Lock()
+	diff := r.diff(shadow.serverName, packet.Command)
+	diff.Compared++
+	if len(fields) > 0 || sizeMismatch {
+		diff.Differing++
+	}
+	if sizeMismatch {
+		diff.SizeMismatches++
+	}
+	for _, field := range fields {
+		diff.Fields[field]++
+	}
+	r.mu.Unlock()
+
+	if len(fields) > 0 || sizeMismatch {
+		detail := strings.Join(fields, ", ")
+		if sizeMismatch {
+			detail = fmt.Sprintf("size %d vs %d; %s", len(primary.DecryptedData), len(shadowed.DecryptedData), detail)
+		}
+		shadow.server.logger.Printf("Shadow %s response %04x in session %d differs: %s\n",
+			shadow.serverName, packet.Command, shadow.sessionID, strings.TrimSuffix(detail, "; "))
+	}
+}
+
+// Stops sending to the shadow server, leaving the session itself unaffected.
+func (shadow *shadowSession) stop() {
+	atomic.StoreInt32(&shadow.stopped, 1)
+	shadow.conn.Close()
+}
+
+// Disconnects from the shadow server once the session is over, counting the
+// responses that only one of the servers sent.
+func (shadow *shadowSession) close() {
+	shadow.closeOnce.Do(func() {
+		close(shadow.queue)
+		shadow.conn.Close()
+
+		shadow.mu.Lock()
+		defer shadow.mu.Unlock()
+		r := &shadow.server.shadowReport
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		for command, packets := range shadow.primary {
+			if len(packets) > 0 {
+				r.diff(shadow.serverName, command).Missing += len(packets)
+			}
+		}
+		for command, packets := range shadow.shadow {
+			if len(packets) > 0 {
+				r.diff(shadow.serverName, command).Extra += len(packets)
+			}
+		}
+	})
+}
+
+// Returns the ranges of bytes that differ between a and b, up to the length of
+// the shorter one, merging differences close enough together to be one field.
+func differingFields(a, b []byte) []string {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	var fields []string
+	for i := 0; i < n; i++ {
+		if a[i] == b[i] {
+			continue
+		}
+		start, end := i, i
+		for j := i + 1; j < n && j <= end+shadowFieldGap; j++ {
+			if a[j] != b[j] {
+				end = j
+			}
+		}
+		fields = append(fields, fmt.Sprintf("0x%04X-0x%04X", start, end))
+		i = end
+	}
+	return fields
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/dcrodman/archon/util"
+)
+
+const (
+	simpleMailType uint16 = 0x81
+	chatType       uint16 = 0x06
+)
+
+// Commands whose text follows an unused word and the sender's guild card
+// number, by the channel they're shown on.
+var textChannels = map[uint16]string{
+	0x01:     "message",
+	chatType: "chat",
+	0x11:     "info",
+	0xB0:     "server",
+	0xEE:     "scroll",
+}
+
+// Languages that may be marked at the start of a piece of text.
+const languageMarkers = "JEGFSBTK"
+
+// ChatMessage is the text carried by a chat, mail or server message packet.
+type ChatMessage struct {
+	Channel string
+	// The sender's guild card number and name, if the packet includes them.
+	Guildcard uint32
+	Name      string
+	// The recipient's guild card number, for mail.
+	To   uint32
+	Text string
+}
+
+func (m *ChatMessage) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s]", m.Channel)
+	if m.Guildcard != 0 {
+		fmt.Fprintf(&b, " %d", m.Guildcard)
+	}
+	if m.Name != "" {
+		fmt.Fprintf(&b, " %s", m.Name)
+	}
+	if m.To != 0 {
+		fmt.Fprintf(&b, " -> %d", m.To)
+	}
+	fmt.Fprintf(&b, ": %s", m.Text)
+	return b.String()
+}
+
+// DecodeChat returns the text in a BB chat, simple mail or server message
+// packet, or nil if the packet doesn't carry any.
+func DecodeChat(packet *PacketMsg) *ChatMessage {
+	if packet.Err != nil || packet.Protocol != ProtocolBB {
+		return nil
+	}
+	var header Header
+	util.StructFromBytes(packet.DecryptedData, &header)
+	end := int(header.Size)
+	if end > len(packet.DecryptedData) {
+		end = len(packet.DecryptedData)
+	}
+	if end < bbHeaderSize {
+		return nil
+	}
+	body := packet.DecryptedData[bbHeaderSize:end]
+
+	if packet.Command == simpleMailType {
+		if len(body) < 0x2C {
+			return nil
+		}
+		return &ChatMessage{
+			Channel:   "mail",
+			Guildcard: binary.LittleEndian.Uint32(body[4:]),
+			Name:      DecodeText(body[8:0x28]),
+			To:        binary.LittleEndian.Uint32(body[0x28:]),
+			Text:      DecodeText(body[0x2C:]),
+		}
+	}
+
+	channel, ok := textChannels[packet.Command]
+	if !ok || len(body) < 8 {
+		return nil
+	}
+	msg := &ChatMessage{Channel: channel, Guildcard: binary.LittleEndian.Uint32(body[4:])}
+	text := utf16Text(body[8:])
+	if packet.Command == chatType && packet.FromName == "Server" {
+		// Chat relayed by the server is prefixed with the speaker's name and a tab.
+		text = stripLanguage(text)
+		if i := strings.IndexByte(text, '\t'); i >= 0 {
+			msg.Name, text = decodeEscapes(text[:i]), text[i+1:]
+		}
+	}
+	msg.Text = decodeEscapes(text)
+	return msg
+}
+
+// DecodeText converts NUL terminated UTF-16LE text from a packet to a string,
+// dropping any language markers (\tE, \tJ, etc.) and writing color escapes
+// (\tC6) the way players type them ($C6).
+func DecodeText(b []byte) string {
+	return decodeEscapes(utf16Text(b))
+}
+
+func utf16Text(b []byte) string {
+	var units []uint16
+	for i := 0; i+1 < len(b); i += 2 {
+		unit := binary.LittleEndian.Uint16(b[i:])
+		if unit == 0 {
+			break
+		}
+		units = append(units, unit)
+	}
+	return string(utf16.Decode(units))
+}
+
+func stripLanguage(text string) string {
+	if len(text) >= 2 && text[0] == '\t' && strings.IndexByte(languageMarkers, text[1]) >= 0 {
+		return text[2:]
+	}
+	return text
+}
+
+func decodeEscapes(text string) string {
+	text = stripLanguage(text)
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\t' && i+1 < len(text) {
+			switch {
+			case text[i+1] == 'C':
+				b.WriteString("$C")
+				i++
+				continue
+			case strings.IndexByte(languageMarkers, text[i+1]) >= 0:
+				i++
+				continue
+			}
+		}
+		b.WriteByte(text[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Balancing selects which of a proxy's servers each new session is sent to.
+type Balancing int
+
+const (
+	// RoundRobin takes turns between the servers.
+	RoundRobin Balancing = iota
+	// LeastSessions picks the server with the fewest active sessions.
+	LeastSessions
+)
+
+// ParseBalancing returns the balancing mode named "roundrobin" or "leastsessions".
+func ParseBalancing(name string) (Balancing, error) {
+	switch strings.ToLower(name) {
+	case "roundrobin", "":
+		return RoundRobin, nil
+	case "leastsessions":
+		return LeastSessions, nil
+	}
+	return RoundRobin, fmt.Errorf("unknown balancing mode %q", name)
+}
+
+// How often the servers of proxies with more than one are checked by default.
+const defaultHealthCheckInterval = 10 * time.Second
+
+// One of the servers that a Proxy forwards sessions to.
+type upstream struct {
+	host string
+	addr *net.TCPAddr
+	// Accessed atomically.
+	sessions int32
+	// Set when connecting to the server fails, and cleared when a session or
+	// health check next succeeds.
+	down int32
+}
+
+// UpstreamStatus describes one of the servers a proxy forwards sessions to.
+type UpstreamStatus struct {
+	Server   string
+	Host     string
+	Healthy  bool
+	Sessions int
+}
+
+// Upstreams returns the state of every proxy's servers.
+func (s *Server) Upstreams() []UpstreamStatus {
+	var statuses []UpstreamStatus
+	for _, proxy := range s.proxies {
+		for _, u := range proxy.upstreams {
+			statuses = append(statuses, UpstreamStatus{
+				Server:   proxy.serverName,
+				Host:     u.host,
+				Healthy:  atomic.LoadInt32(&u.down) == 0,
+				Sessions: int(atomic.LoadInt32(&u.sessions)),
+			})
+		}
+	}
+	return statuses
+}
+
+// Returns the proxy's servers in the order to try them for a new session: the
+// healthy ones as picked by the balancing mode, followed by the rest in case
+// they've come back since they were last checked.
+func (proxy *Proxy) upstreamOrder() []*upstream {
+	n := len(proxy.upstreams)
+	ordered := make([]*upstream, 0, n)
+	switch proxy.balancing {
+	case LeastSessions:
+		ordered = append(ordered, proxy.upstreams...)
+		// Stable, so that ties go to the servers listed first.
+		for i := 1; i < n; i++ {
+			for j := i; j > 0 && atomic.LoadInt32(&ordered[j].sessions) < atomic.LoadInt32(&ordered[j-1].sessions); j-- {
+				ordered[j], ordered[j-1] = ordered[j-1], ordered[j]
+			}
+		}
+	default:
+		start := int(atomic.AddUint32(&proxy.nextUpstream, 1)-1) % n
+		for i := 0; i < n; i++ {
+			ordered = append(ordered, proxy.upstreams[(start+i)%n])
+		}
+	}
+
+	var healthy, down []*upstream
+	for _, u := range ordered {
+		if atomic.LoadInt32(&u.down) == 0 {
+			healthy = append(healthy, u)
+		} else {
+			down = append(down, u)
+		}
+	}
+	return append(healthy, down...)
+}
+
+// Connects to one of the proxy's servers on behalf of client and reads its
+// welcome packet, failing over to the next server if either step fails. Once
+// every server has failed, it retries with exponential backoff.
+func (proxy *Proxy) connectServer(client net.Conn) (net.Conn, *upstream, []byte, Protocol, error) {
+	backoff := proxy.server.dialBackoff
+	for attempt := 0; ; attempt++ {
+		var lastErr error
+		for _, u := range proxy.upstreamOrder() {
+			conn, welcome, protocol, err := proxy.connectUpstream(u, client)
+			if err == nil {
+				proxy.setHealthy(u, nil)
+				return conn, u, welcome, protocol, nil
+			}
+			proxy.server.logger.Printf("Failed to connect to %s server %s: %s\n", proxy.serverName, u.host, err.Error())
+			proxy.setHealthy(u, err)
+			lastErr = err
+		}
+		if attempt >= proxy.server.dialRetries {
+			return nil, nil, nil, 0, lastErr
+		}
+		proxy.server.logger.Printf("No %s server reachable (attempt %d); retrying in %s\n",
+			proxy.serverName, attempt+1, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-proxy.server.done:
+			return nil, nil, nil, 0, lastErr
+		}
+		backoff *= 2
+	}
+}
+
+// Opens a connection to u on behalf of client, which is nil for health checks,
+// and intercepts the encryption vectors from its welcome packet. Failed health
+// checks only show up in upstream_up, leaving the error counters to sessions.
+func (proxy *Proxy) connectUpstream(u *upstream, client net.Conn) (net.Conn, []byte, Protocol, error) {
+	conn, err := net.DialTimeout("tcp", u.addr.String(), proxy.server.dialTimeout)
+	if err != nil {
+		if client != nil {
+			proxy.server.metrics.dialErrors.WithLabelValues(proxy.serverName).Inc()
+		}
+		return nil, nil, 0, err
+	}
+	if err := proxy.server.sendProxyHeader(conn, client); err != nil {
+		conn.Close()
+		return nil, nil, 0, err
+	}
+	welcome, protocol, err := readWelcome(conn, proxy.server.handshakeTimeout)
+	if err != nil {
+		if client != nil {
+			proxy.server.metrics.handshakeFailures.WithLabelValues(proxy.serverName).Inc()
+		}
+		conn.Close()
+		return nil, nil, 0, fmt.Errorf("handshake failed: %s", err.Error())
+	}
+	return conn, welcome, protocol, nil
+}
+
+// Records whether the last attempt to reach u succeeded, logging changes.
+func (proxy *Proxy) setHealthy(u *upstream, err error) {
+	var down int32
+	if err != nil {
+		down = 1
+	}
+	if atomic.SwapInt32(&u.down, down) == down {
+		return
+	}
+	proxy.server.metrics.upstreamUp.WithLabelValues(proxy.serverName, u.host).Set(float64(1 - down))
+	if err != nil {
+		proxy.server.logger.Printf("%s server %s is down: %s\n", proxy.serverName, u.host, err.Error())
+	} else {
+		proxy.server.logger.Printf("%s server %s is back up\n", proxy.serverName, u.host)
+	}
+}
+
+// Connects to each of the proxy's servers every interval, until the Server is
+// stopped, so that failed ones are noticed before clients are sent to them and
+// recovered ones are used again.
+func (proxy *Proxy) checkHealth(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-proxy.server.done:
+			return
+		}
+		for _, u := range proxy.upstreams {
+			conn, _, _, err := proxy.connectUpstream(u, nil)
+			if err == nil {
+				conn.Close()
+			}
+			proxy.setHealthy(u, err)
+		}
+	}
+}
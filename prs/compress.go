@@ -0,0 +1,140 @@
+package prs
+
+// How many earlier positions with the same 3 byte prefix to try when looking
+// for a match. Higher values compress slightly better but take longer.
+const maxChainLength = 128
+
+type writer struct {
+	out []byte
+	// Index of the control byte being filled in, and how many bits it has.
+	control int
+	bits    int
+}
+
+func (w *writer) bit(set bool) {
+	if w.bits == 0 || w.bits == 8 {
+		w.control = len(w.out)
+		w.out = append(w.out, 0)
+		w.bits = 0
+	}
+	if set {
+		w.out[w.control] |= 1 << uint(w.bits)
+	}
+	w.bits++
+}
+
+func (w *writer) literal(b byte) {
+	w.bit(true)
+	w.out = append(w.out, b)
+}
+
+// Writes a copy of size bytes from offset bytes back (offset is negative).
+func (w *writer) copy(offset, size int) {
+	if -offset <= shortMaxOffset && size >= shortMinSize && size <= shortMaxSize {
+		size -= shortMinSize
+		w.bit(false)
+		w.bit(false)
+		w.bit(size&2 != 0)
+		w.bit(size&1 != 0)
+		w.out = append(w.out, byte(offset))
+		return
+	}
+	word := (offset & (longMaxOffset - 1)) << 3
+	w.bit(false)
+	w.bit(true)
+	if size >= longMinSize && size <= longMaxSize {
+		word |= size - 2
+		w.out = append(w.out, byte(word), byte(word>>8))
+	} else {
+		w.out = append(w.out, byte(word), byte(word>>8), byte(size-1))
+	}
+}
+
+func (w *writer) end() []byte {
+	w.bit(false)
+	w.bit(true)
+	return append(w.out, 0, 0)
+}
+
+// Compress returns data compressed with PRS. The output is not byte-for-byte
+// identical to Sega's compressor, but any PRS decompressor will accept it.
+func Compress(data []byte) []byte {
+	w := &writer{out: make([]byte, 0, len(data)/2+16)}
+
+	// Chains of earlier positions sharing the same 3 byte prefix.
+	head := make(map[uint32]int)
+	prev := make([]int, len(data))
+	insert := func(pos int) {
+		if pos+3 > len(data) {
+			return
+		}
+		key := uint32(data[pos]) | uint32(data[pos+1])<<8 | uint32(data[pos+2])<<16
+		if last, ok := head[key]; ok {
+			prev[pos] = last
+		} else {
+			prev[pos] = -1
+		}
+		head[key] = pos
+	}
+
+	for pos := 0; pos < len(data); {
+		offset, size := findMatch(data, pos, head, prev)
+		if size == 0 {
+			w.literal(data[pos])
+			insert(pos)
+			pos++
+			continue
+		}
+		w.copy(offset, size)
+		for end := pos + size; pos < end; pos++ {
+			insert(pos)
+		}
+	}
+	return w.end()
+}
+
+// Returns the negative offset and size of the longest earlier match for the
+// data at pos, or a size of zero if there's nothing worth copying.
+func findMatch(data []byte, pos int, head map[uint32]int, prev []int) (int, int) {
+	limit := len(data) - pos
+	if limit > extMaxSize {
+		limit = extMaxSize
+	}
+	bestOffset, bestSize := 0, 0
+
+	if limit >= 3 {
+		key := uint32(data[pos]) | uint32(data[pos+1])<<8 | uint32(data[pos+2])<<16
+		candidate, ok := head[key]
+		for chain := 0; ok && candidate >= 0 && pos-candidate <= longMaxOffset-1 && chain < maxChainLength; chain++ {
+			size := matchLength(data, candidate, pos, limit)
+			if size > bestSize {
+				bestOffset, bestSize = candidate-pos, size
+				if size == limit {
+					break
+				}
+			}
+			candidate = prev[candidate]
+		}
+	}
+	if bestSize >= longMinSize {
+		return bestOffset, bestSize
+	}
+
+	// Two byte matches are only worth it as short copies.
+	if limit >= shortMinSize {
+		for candidate := pos - 1; candidate >= 0 && pos-candidate <= shortMaxOffset; candidate-- {
+			if data[candidate] == data[pos] && data[candidate+1] == data[pos+1] {
+				return candidate - pos, shortMinSize
+			}
+		}
+	}
+	return 0, 0
+}
+
+func matchLength(data []byte, from, pos, limit int) int {
+	size := 0
+	for size < limit && data[from+size] == data[pos+size] {
+		size++
+	}
+	return size
+}
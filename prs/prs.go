@@ -0,0 +1,154 @@
+// Package prs implements Sega's PRS compression, an LZ77 variant used for the
+// quest files and many of the parameter files sent to PSO clients.
+//
+// A PRS stream interleaves control bytes with data. Control bits are consumed
+// least significant bit first, with a new control byte read whenever the last
+// one runs out, and select between:
+//
+//	1            literal byte
+//	0 0 s s o    copy 2-5 bytes from up to 256 bytes back
+//	0 1 w w [n]  copy 3-9 bytes (or 1-256 with an extra length byte) from up
+//	             to 8192 bytes back
+//
+// A long copy with an offset of zero marks the end of the stream.
+package prs
+
+import "errors"
+
+const (
+	shortMaxOffset = 0x100
+	shortMinSize   = 2
+	shortMaxSize   = 5
+
+	longMaxOffset = 0x2000
+	longMinSize   = 3
+	longMaxSize   = 9
+	extMaxSize    = 0x100
+)
+
+// ErrCorrupt is returned when compressed data ends early or refers to data
+// before the start of the output.
+var ErrCorrupt = errors.New("prs: corrupt data")
+
+// ErrTooLarge is returned by DecompressLimit when the output would be larger than
+// allowed.
+var ErrTooLarge = errors.New("prs: decompressed data too large")
+
+type reader struct {
+	data    []byte
+	pos     int
+	control byte
+	bits    int
+}
+
+func (r *reader) byte() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, ErrCorrupt
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *reader) bit() (bool, error) {
+	if r.bits == 0 {
+		var err error
+		if r.control, err = r.byte(); err != nil {
+			return false, err
+		}
+		r.bits = 8
+	}
+	bit := r.control&1 != 0
+	r.control >>= 1
+	r.bits--
+	return bit, nil
+}
+
+// Decompress returns the decompressed contents of data.
+func Decompress(data []byte) ([]byte, error) {
+	return DecompressLimit(data, -1)
+}
+
+// DecompressLimit is like Decompress but returns ErrTooLarge rather than produce
+// more than max bytes, or any number if max is negative. Each copy can expand a
+// few bytes of input into hundreds, so untrusted data should be given a limit.
+func DecompressLimit(data []byte, max int) ([]byte, error) {
+	r := &reader{data: data}
+	out := make([]byte, 0, len(data)*2)
+	for {
+		literal, err := r.bit()
+		if err != nil {
+			return nil, err
+		}
+		if literal {
+			b, err := r.byte()
+			if err != nil {
+				return nil, err
+			}
+			if max >= 0 && len(out) >= max {
+				return nil, ErrTooLarge
+			}
+			out = append(out, b)
+			continue
+		}
+
+		var offset, size int
+		long, err := r.bit()
+		if err != nil {
+			return nil, err
+		}
+		if long {
+			lo, err := r.byte()
+			if err != nil {
+				return nil, err
+			}
+			hi, err := r.byte()
+			if err != nil {
+				return nil, err
+			}
+			word := int(lo) | int(hi)<<8
+			if word == 0 {
+				return out, nil
+			}
+			offset = (word >> 3) - longMaxOffset
+			if size = word & 7; size == 0 {
+				n, err := r.byte()
+				if err != nil {
+					return nil, err
+				}
+				size = int(n) + 1
+			} else {
+				size += 2
+			}
+		} else {
+			for i := 0; i < 2; i++ {
+				bit, err := r.bit()
+				if err != nil {
+					return nil, err
+				}
+				size <<= 1
+				if bit {
+					size |= 1
+				}
+			}
+			size += shortMinSize
+			b, err := r.byte()
+			if err != nil {
+				return nil, err
+			}
+			offset = int(b) - shortMaxOffset
+		}
+
+		start := len(out) + offset
+		if start < 0 {
+			return nil, ErrCorrupt
+		}
+		if max >= 0 && len(out)+size > max {
+			return nil, ErrTooLarge
+		}
+		// Copies may overlap the bytes they produce, so go one at a time.
+		for i := 0; i < size; i++ {
+			out = append(out, out[start+i])
+		}
+	}
+}
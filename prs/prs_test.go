@@ -0,0 +1,148 @@
+package prs
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func randomBytes(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"single byte", []byte{0x42}},
+		{"two bytes", []byte{0x42, 0x42}},
+		{"long run", bytes.Repeat([]byte{0xAA}, 100000)},
+		{"repeated text", bytes.Repeat([]byte("Phantasy Star Online "), 500)},
+		{"random", randomBytes(1, 0x10000)},
+		{"random with repeats", append(append(randomBytes(2, 0x3000), randomBytes(2, 0x3000)...), randomBytes(3, 0x100)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compressed := Compress(tt.data)
+			got, err := Decompress(compressed)
+			if err != nil {
+				t.Fatalf("Decompress returned %v", err)
+			}
+			if !bytes.Equal(got, tt.data) {
+				t.Fatalf("round trip returned %d bytes that differ from the %d given", len(got), len(tt.data))
+			}
+		})
+	}
+}
+
+// A block repeated exactly 0x1FFF bytes later can be copied, but not one
+// repeated 0x2000 bytes later.
+func TestMaxOffset(t *testing.T) {
+	block := randomBytes(4, extMaxSize)
+	compress := func(distance int) []byte {
+		data := append([]byte(nil), block...)
+		data = append(data, randomBytes(5, distance-len(block))...)
+		data = append(data, block...)
+		compressed := Compress(data)
+		got, err := Decompress(compressed)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("round trip with the block repeated after 0x%X bytes failed: %v", distance, err)
+		}
+		return compressed
+	}
+
+	inRange := compress(longMaxOffset - 1)
+	outOfRange := compress(longMaxOffset)
+	if len(outOfRange)-len(inRange) < len(block)/2 {
+		t.Errorf("block 0x1FFF bytes back wasn't copied: %d bytes compressed vs %d", len(inRange), len(outOfRange))
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	tests := []struct {
+		name       string
+		compressed []byte
+		want       []byte
+	}{
+		// Literal, long copy of 20 bytes from 1 back with an extra length byte, end.
+		{"extended length copy", []byte{0x15, 'a', 0xF8, 0xFF, 0x13, 0x00, 0x00}, bytes.Repeat([]byte{'a'}, 21)},
+		// Two literals, short copy of 3 bytes from 2 back, end.
+		{"short copy", []byte{0xA3, 'a', 'b', 0xFE, 0x00, 0x00}, []byte("ababa")},
+		{"end only", []byte{0x02, 0x00, 0x00}, []byte{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decompress(tt.compressed)
+			if err != nil {
+				t.Fatalf("Decompress returned %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Decompress returned %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecompressCorrupt(t *testing.T) {
+	tests := []struct {
+		name       string
+		compressed []byte
+	}{
+		{"empty", nil},
+		{"missing literal", []byte{0x01}},
+		{"missing end", []byte{0x01, 'a'}},
+		{"truncated long copy", []byte{0x05, 'a', 0xF8}},
+		{"truncated extra length", []byte{0x05, 'a', 0xF8, 0xFF}},
+		// Short copy from 1 back with nothing written yet.
+		{"short copy before start", []byte{0x00, 0xFF}},
+		// Long copy from 0x1FFF back after one literal.
+		{"long copy before start", []byte{0x05, 'a', 0x09, 0x00}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Decompress(tt.compressed); !errors.Is(err, ErrCorrupt) {
+				t.Errorf("Decompress returned %v, want ErrCorrupt", err)
+			}
+		})
+	}
+}
+
+// Every truncation of a valid stream is missing at least its end marker.
+func TestDecompressTruncated(t *testing.T) {
+	compressed := Compress(bytes.Repeat([]byte("quest data "), 200))
+	for n := 0; n < len(compressed); n++ {
+		if _, err := Decompress(compressed[:n]); !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("Decompress of the first %d of %d bytes returned %v, want ErrCorrupt", n, len(compressed), err)
+		}
+	}
+}
+
+// A stream of maximum length copies expands to far more than its own size.
+func TestDecompressLimit(t *testing.T) {
+	w := &writer{}
+	w.literal('a')
+	for i := 0; i < 1000; i++ {
+		w.copy(-1, extMaxSize)
+	}
+	bomb := w.end()
+	size := 1 + 1000*extMaxSize
+
+	if _, err := DecompressLimit(bomb, 0x10000); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("DecompressLimit of a %d byte stream returned %v, want ErrTooLarge", len(bomb), err)
+	}
+	if _, err := DecompressLimit(bomb, size-1); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("DecompressLimit one byte short returned %v, want ErrTooLarge", err)
+	}
+	got, err := DecompressLimit(bomb, size)
+	if err != nil || !bytes.Equal(got, bytes.Repeat([]byte{'a'}, size)) {
+		t.Errorf("DecompressLimit at the exact size returned %d bytes, %v", len(got), err)
+	}
+	if _, err := DecompressLimit([]byte{0x01, 'a'}, 0); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("DecompressLimit of a literal past the limit returned %v, want ErrTooLarge", err)
+	}
+}
@@ -0,0 +1,402 @@
+// Package quest disassembles the script in PSO quest .bin files into a listing
+// of its instructions, labels and strings.
+package quest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/dcrodman/archon/util"
+)
+
+// Header at the start of a decompressed BB quest .bin file.
+type binHeader struct {
+	CodeOffset          uint32
+	FunctionTableOffset uint32
+	Size                uint32
+	Unused              uint32
+	QuestNumber         uint16
+	Unused2             uint16
+	Episode             uint8
+	MaxPlayers          uint8
+	Joinable            uint8
+	Unknown             uint8
+	Name                [0x40]byte
+	ShortDescription    [0x100]byte
+	LongDescription     [0x240]byte
+}
+
+const binHeaderSize = 0x398
+
+// Function table entries that aren't used.
+const noLabel = 0xFFFFFFFF
+
+var episodes = map[uint8]int{0: 1, 1: 2, 2: 4}
+
+// A decoded instruction.
+type instruction struct {
+	size     int
+	name     string
+	args     []string
+	strings  []string
+	codeRefs []int
+	dataRefs []int
+	terminal bool
+}
+
+// A run of the script starting at one or more labels.
+type segment struct {
+	start, end int
+	labels     []int
+	data       bool
+}
+
+// Disassemble returns a listing of a decompressed BB quest .bin file.
+func Disassemble(bin []byte) (string, error) {
+	if len(bin) < binHeaderSize {
+		return "", errors.New("quest: file is too short for a header")
+	}
+	var header binHeader
+	util.StructFromBytes(bin, &header)
+	tableEnd := len(bin)
+	if header.Size >= header.FunctionTableOffset && int(header.Size) < tableEnd {
+		tableEnd = int(header.Size)
+	}
+	if header.CodeOffset > header.FunctionTableOffset || int(header.FunctionTableOffset) > tableEnd {
+		return "", fmt.Errorf("quest: invalid code offset %x or function table offset %x",
+			header.CodeOffset, header.FunctionTableOffset)
+	}
+	code := bin[header.CodeOffset:header.FunctionTableOffset]
+	table := bin[header.FunctionTableOffset:tableEnd]
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "; Quest %d: %s\n", header.QuestNumber, utf16String(header.Name[:]))
+	fmt.Fprintf(&out, "; Episode %d, up to %d players\n", episodes[header.Episode], header.MaxPlayers)
+	writeComment(&out, utf16String(header.ShortDescription[:]))
+	writeComment(&out, utf16String(header.LongDescription[:]))
+
+	segments, invalid := splitSegments(code, table)
+	fmt.Fprintf(&out, "; %d byte script, %d entry function table\n", len(code), len(table)/4)
+	for _, label := range invalid {
+		fmt.Fprintf(&out, "; L%d points outside of the script\n", label)
+	}
+
+	markData(code, segments)
+	stringTable := make(map[string][]int)
+	for _, seg := range segments {
+		out.WriteString("\n")
+		for _, label := range seg.labels {
+			fmt.Fprintf(&out, "L%d:\n", label)
+		}
+		if seg.data {
+			writeData(&out, code, seg.start, seg.end)
+			continue
+		}
+		for pos := seg.start; pos < seg.end; {
+			inst, err := decode(code, pos)
+			if err != nil || pos+inst.size > seg.end {
+				if err == nil {
+					err = errors.New("instruction runs past the next label")
+				}
+				fmt.Fprintf(&out, "\t; %s\n", err.Error())
+				writeData(&out, code, pos, seg.end)
+				break
+			}
+			fmt.Fprintf(&out, "\t%04X  %s", pos, inst.name)
+			if len(inst.args) > 0 {
+				fmt.Fprintf(&out, " %s", strings.Join(inst.args, ", "))
+			}
+			out.WriteString("\n")
+			for _, s := range inst.strings {
+				stringTable[s] = append(stringTable[s], pos)
+			}
+			pos += inst.size
+			// Anything after the end of the flow can only be reached some other way,
+			// such as through a label that isn't in the function table.
+			if inst.terminal && pos < seg.end {
+				out.WriteString("\n\t; not reached from above\n")
+			}
+		}
+	}
+	writeStringTable(&out, stringTable)
+	return out.String(), nil
+}
+
+// Splits the script at every label in the function table, returning the
+// segments in order along with any labels that don't point into the script.
+func splitSegments(code, table []byte) ([]*segment, []int) {
+	byOffset := map[int]*segment{0: {start: 0}}
+	var invalid []int
+	for label := 0; label*4+4 <= len(table); label++ {
+		offset := binary.LittleEndian.Uint32(table[label*4:])
+		if offset == noLabel {
+			continue
+		}
+		if int(offset) >= len(code) {
+			invalid = append(invalid, label)
+			continue
+		}
+		seg := byOffset[int(offset)]
+		if seg == nil {
+			seg = &segment{start: int(offset)}
+			byOffset[int(offset)] = seg
+		}
+		seg.labels = append(seg.labels, label)
+	}
+
+	var segments []*segment
+	for _, seg := range byOffset {
+		segments = append(segments, seg)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].start < segments[j].start })
+	for i, seg := range segments {
+		seg.end = len(code)
+		if i+1 < len(segments) {
+			seg.end = segments[i+1].start
+		}
+	}
+	return segments, invalid
+}
+
+// Marks the segments that are only ever referred to as data (by leto and
+// arg_pusho) so that they're dumped rather than disassembled. Everything else
+// is assumed to be code, since functions are often referred to by plain
+// numbers passed to handlers.
+func markData(code []byte, segments []*segment) {
+	codeLabels, dataLabels := make(map[int]bool), make(map[int]bool)
+	for _, seg := range segments {
+		for pos := seg.start; pos < seg.end; {
+			inst, err := decode(code, pos)
+			if err != nil {
+				break
+			}
+			for _, label := range inst.codeRefs {
+				codeLabels[label] = true
+			}
+			for _, label := range inst.dataRefs {
+				dataLabels[label] = true
+			}
+			pos += inst.size
+		}
+	}
+	for _, seg := range segments {
+		if seg.start == 0 || len(seg.labels) == 0 {
+			continue
+		}
+		seg.data = true
+		for _, label := range seg.labels {
+			if codeLabels[label] || !dataLabels[label] {
+				seg.data = false
+			}
+		}
+	}
+}
+
+var errTruncated = errors.New("instruction is truncated")
+
+// Decodes the instruction at pos.
+func decode(code []byte, pos int) (instruction, error) {
+	var inst instruction
+	r := &scriptReader{data: code, pos: pos}
+
+	b, ok := r.byte()
+	if !ok {
+		return inst, errTruncated
+	}
+	op := uint16(b)
+	if b == 0xF8 || b == 0xF9 {
+		b2, ok := r.byte()
+		if !ok {
+			return inst, errTruncated
+		}
+		op = op<<8 | uint16(b2)
+	}
+	info, known := opcodes[op]
+	if !known {
+		return inst, fmt.Errorf("unknown opcode %02X", op)
+	}
+	inst.name, inst.terminal = info.name, info.terminal
+
+	for _, arg := range info.args {
+		var value string
+		switch arg {
+		case argReg:
+			v, ok := r.byte()
+			if !ok {
+				return inst, errTruncated
+			}
+			value = fmt.Sprintf("r%d", v)
+		case argByte:
+			v, ok := r.byte()
+			if !ok {
+				return inst, errTruncated
+			}
+			value = strconv.Itoa(int(v))
+		case argWord:
+			v, ok := r.uint16()
+			if !ok {
+				return inst, errTruncated
+			}
+			value = strconv.Itoa(int(v))
+		case argInt:
+			v, ok := r.uint32()
+			if !ok {
+				return inst, errTruncated
+			}
+			value = strconv.Itoa(int(int32(v)))
+		case argLabel, argData:
+			v, ok := r.uint16()
+			if !ok {
+				return inst, errTruncated
+			}
+			value = fmt.Sprintf("L%d", v)
+			if arg == argLabel {
+				inst.codeRefs = append(inst.codeRefs, int(v))
+			} else {
+				inst.dataRefs = append(inst.dataRefs, int(v))
+			}
+		case argRegList, argLabelList:
+			count, ok := r.byte()
+			if !ok {
+				return inst, errTruncated
+			}
+			var items []string
+			for i := 0; i < int(count); i++ {
+				if arg == argRegList {
+					v, ok := r.byte()
+					if !ok {
+						return inst, errTruncated
+					}
+					items = append(items, fmt.Sprintf("r%d", v))
+				} else {
+					v, ok := r.uint16()
+					if !ok {
+						return inst, errTruncated
+					}
+					items = append(items, fmt.Sprintf("L%d", v))
+					inst.codeRefs = append(inst.codeRefs, int(v))
+				}
+			}
+			value = "[" + strings.Join(items, ", ") + "]"
+		case argString:
+			s, ok := r.string()
+			if !ok {
+				return inst, errTruncated
+			}
+			value = strconv.Quote(s)
+			inst.strings = append(inst.strings, s)
+		}
+		inst.args = append(inst.args, value)
+	}
+	inst.size = r.pos - pos
+	return inst, nil
+}
+
+type scriptReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *scriptReader) byte() (byte, bool) {
+	if r.pos+1 > len(r.data) {
+		return 0, false
+	}
+	r.pos++
+	return r.data[r.pos-1], true
+}
+
+func (r *scriptReader) uint16() (uint16, bool) {
+	if r.pos+2 > len(r.data) {
+		return 0, false
+	}
+	r.pos += 2
+	return binary.LittleEndian.Uint16(r.data[r.pos-2:]), true
+}
+
+func (r *scriptReader) uint32() (uint32, bool) {
+	if r.pos+4 > len(r.data) {
+		return 0, false
+	}
+	r.pos += 4
+	return binary.LittleEndian.Uint32(r.data[r.pos-4:]), true
+}
+
+func (r *scriptReader) string() (string, bool) {
+	var units []uint16
+	for {
+		unit, ok := r.uint16()
+		if !ok {
+			return "", false
+		}
+		if unit == 0 {
+			return string(utf16.Decode(units)), true
+		}
+		units = append(units, unit)
+	}
+}
+
+// Converts a fixed size, NUL terminated UTF-16LE field to a string.
+func utf16String(b []byte) string {
+	r := &scriptReader{data: b}
+	s, ok := r.string()
+	if !ok {
+		// Not terminated within the field; take all of it.
+		r.pos = 0
+		var units []uint16
+		for unit, ok := r.uint16(); ok; unit, ok = r.uint16() {
+			units = append(units, unit)
+		}
+		s = string(utf16.Decode(units))
+	}
+	return s
+}
+
+func writeComment(out *bytes.Buffer, text string) {
+	if text == "" {
+		return
+	}
+	out.WriteString(";\n")
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		fmt.Fprintf(out, "; %s\n", line)
+	}
+}
+
+func writeData(out *bytes.Buffer, code []byte, start, end int) {
+	for pos := start; pos < end; pos += 16 {
+		lineEnd := pos + 16
+		if lineEnd > end {
+			lineEnd = end
+		}
+		fmt.Fprintf(out, "\t%04X  .data", pos)
+		for _, b := range code[pos:lineEnd] {
+			fmt.Fprintf(out, " %02X", b)
+		}
+		out.WriteString("\n")
+	}
+}
+
+func writeStringTable(out *bytes.Buffer, table map[string][]int) {
+	if len(table) == 0 {
+		return
+	}
+	var strs []string
+	for s := range table {
+		strs = append(strs, s)
+	}
+	sort.Slice(strs, func(i, j int) bool { return table[strs[i]][0] < table[strs[j]][0] })
+
+	out.WriteString("\n; Strings\n")
+	for i, s := range strs {
+		var refs []string
+		for _, pos := range table[s] {
+			refs = append(refs, fmt.Sprintf("%04X", pos))
+		}
+		fmt.Fprintf(out, "; %3d  %s  (%s)\n", i, strconv.Quote(s), strings.Join(refs, ", "))
+	}
+}
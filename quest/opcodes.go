@@ -0,0 +1,279 @@
+package quest
+
+// Types of the immediate arguments that follow an opcode.
+type argType int
+
+const (
+	argReg       argType = iota // register number (1 byte)
+	argByte                     // 8 bit integer
+	argWord                     // 16 bit integer
+	argInt                      // 32 bit integer
+	argLabel                    // function table index of code (2 bytes)
+	argData                     // function table index of data (2 bytes)
+	argRegList                  // count byte followed by that many registers
+	argLabelList                // count byte followed by that many code labels
+	argString                   // NUL terminated UTF-16LE string
+)
+
+type opcode struct {
+	name string
+	args []argType
+	// Control never continues to the next instruction.
+	terminal bool
+}
+
+var (
+	reg      = []argType{argReg}
+	regReg   = []argType{argReg, argReg}
+	regInt   = []argType{argReg, argInt}
+	regRegL  = []argType{argReg, argReg, argLabel}
+	regIntL  = []argType{argReg, argInt, argLabel}
+	label    = []argType{argLabel}
+	labelReg = []argType{argLabel, argRegList}
+	regLabel = []argType{argReg, argLabelList}
+)
+
+// Opcodes as used by BB quests. Apart from the core instructions, v3 and BB take
+// their arguments from the stack (pushed with the arg_push instructions), so
+// only the opcodes that store a result in a register and set_episode have
+// immediate arguments.
+var opcodes = map[uint16]opcode{
+	0x00: {name: "nop"},
+	0x01: {name: "ret", terminal: true},
+	0x02: {name: "sync"},
+	0x03: {name: "exit", args: []argType{argInt}, terminal: true},
+	0x04: {name: "thread", args: label},
+	0x05: {name: "va_start"},
+	0x06: {name: "va_end"},
+	0x07: {name: "va_call", args: label},
+	0x08: {name: "let", args: regReg},
+	0x09: {name: "leti", args: regInt},
+	0x0A: {name: "letb", args: []argType{argReg, argByte}},
+	0x0B: {name: "letw", args: []argType{argReg, argWord}},
+	0x0C: {name: "leta", args: regReg},
+	0x0D: {name: "leto", args: []argType{argReg, argData}},
+	0x10: {name: "set", args: reg},
+	0x11: {name: "clear", args: reg},
+	0x12: {name: "rev", args: reg},
+	0x13: {name: "gset", args: []argType{argWord}},
+	0x14: {name: "gclear", args: []argType{argWord}},
+	0x15: {name: "grev", args: []argType{argWord}},
+	0x16: {name: "glet", args: []argType{argWord, argReg}},
+	0x17: {name: "gget", args: []argType{argWord, argReg}},
+	0x18: {name: "add", args: regReg},
+	0x19: {name: "addi", args: regInt},
+	0x1A: {name: "sub", args: regReg},
+	0x1B: {name: "subi", args: regInt},
+	0x1C: {name: "mul", args: regReg},
+	0x1D: {name: "muli", args: regInt},
+	0x1E: {name: "div", args: regReg},
+	0x1F: {name: "divi", args: regInt},
+	0x20: {name: "and", args: regReg},
+	0x21: {name: "andi", args: regInt},
+	0x22: {name: "or", args: regReg},
+	0x23: {name: "ori", args: regInt},
+	0x24: {name: "xor", args: regReg},
+	0x25: {name: "xori", args: regInt},
+	0x26: {name: "mod", args: regReg},
+	0x27: {name: "modi", args: regInt},
+	0x28: {name: "jmp", args: label, terminal: true},
+	0x29: {name: "call", args: label},
+	0x2A: {name: "jmp_on", args: labelReg},
+	0x2B: {name: "jmp_off", args: labelReg},
+	0x2C: {name: "jmp_=", args: regRegL},
+	0x2D: {name: "jmpi_=", args: regIntL},
+	0x2E: {name: "jmp_!=", args: regRegL},
+	0x2F: {name: "jmpi_!=", args: regIntL},
+	0x30: {name: "ujmp_>", args: regRegL},
+	0x31: {name: "ujmpi_>", args: regIntL},
+	0x32: {name: "jmp_>", args: regRegL},
+	0x33: {name: "jmpi_>", args: regIntL},
+	0x34: {name: "ujmp_<", args: regRegL},
+	0x35: {name: "ujmpi_<", args: regIntL},
+	0x36: {name: "jmp_<", args: regRegL},
+	0x37: {name: "jmpi_<", args: regIntL},
+	0x38: {name: "ujmp_>=", args: regRegL},
+	0x39: {name: "ujmpi_>=", args: regIntL},
+	0x3A: {name: "jmp_>=", args: regRegL},
+	0x3B: {name: "jmpi_>=", args: regIntL},
+	0x3C: {name: "ujmp_<=", args: regRegL},
+	0x3D: {name: "ujmpi_<=", args: regIntL},
+	0x3E: {name: "jmp_<=", args: regRegL},
+	0x3F: {name: "jmpi_<=", args: regIntL},
+	0x40: {name: "switch_jmp", args: regLabel, terminal: true},
+	0x41: {name: "switch_call", args: regLabel},
+	0x42: {name: "stack_push", args: reg},
+	0x43: {name: "stack_pop", args: reg},
+	0x44: {name: "stack_pushm", args: regInt},
+	0x45: {name: "stack_popm", args: regInt},
+	0x48: {name: "arg_pushr", args: reg},
+	0x49: {name: "arg_pushl", args: []argType{argInt}},
+	0x4A: {name: "arg_pushb", args: []argType{argByte}},
+	0x4B: {name: "arg_pushw", args: []argType{argWord}},
+	0x4C: {name: "arg_pusha", args: reg},
+	0x4D: {name: "arg_pusho", args: []argType{argData}},
+	0x4E: {name: "arg_pushs", args: []argType{argString}},
+	0x50: {name: "message"},
+	0x51: {name: "list"},
+	0x52: {name: "fadein"},
+	0x53: {name: "fadeout"},
+	0x54: {name: "se"},
+	0x55: {name: "bgm"},
+	0x58: {name: "enable"},
+	0x59: {name: "disable"},
+	0x5A: {name: "window_msg"},
+	0x5B: {name: "add_msg"},
+	0x5C: {name: "mesend"},
+	0x5D: {name: "gettime", args: reg},
+	0x5E: {name: "winend"},
+	0x60: {name: "npc_crt"},
+	0x61: {name: "npc_stop"},
+	0x62: {name: "npc_play"},
+	0x63: {name: "npc_kill"},
+	0x64: {name: "npc_nont"},
+	0x65: {name: "npc_talk"},
+	0x66: {name: "npc_crp"},
+	0x68: {name: "create_pipe"},
+	0x69: {name: "p_hpstat"},
+	0x6A: {name: "p_dead"},
+	0x6B: {name: "p_disablewarp"},
+	0x6C: {name: "p_enablewarp"},
+	0x6D: {name: "p_move"},
+	0x6E: {name: "p_look"},
+	0x70: {name: "p_action_disable"},
+	0x71: {name: "p_action_enable"},
+	0x72: {name: "disable_movement1"},
+	0x73: {name: "enable_movement1"},
+	0x74: {name: "p_noncol"},
+	0x75: {name: "p_col"},
+	0x76: {name: "p_setpos"},
+	0x77: {name: "p_return_guild"},
+	0x78: {name: "p_talk_guild"},
+	0x79: {name: "npc_talk_pl"},
+	0x7A: {name: "npc_talk_kill"},
+	0x7B: {name: "npc_crtpk"},
+	0x7C: {name: "npc_crppk"},
+	0x7D: {name: "npc_crptalk"},
+	0x7E: {name: "p_look_at"},
+	0x7F: {name: "npc_crp_id"},
+	0x80: {name: "cam_quake"},
+	0x81: {name: "cam_adj"},
+	0x82: {name: "cam_zmin"},
+	0x83: {name: "cam_zmout"},
+	0x84: {name: "cam_pan"},
+	0x85: {name: "game_lev_super"},
+	0x86: {name: "game_lev_reset"},
+	0x87: {name: "pos_pipe"},
+	0x88: {name: "if_zone_clear"},
+	0x89: {name: "chk_ene_num"},
+	0x8A: {name: "unhide_obj"},
+	0x8B: {name: "unhide_ene"},
+	0x8C: {name: "at_coords_call"},
+	0x8D: {name: "at_coords_talk"},
+	0x8E: {name: "col_npcin"},
+	0x8F: {name: "col_npcinr"},
+	0x90: {name: "switch_on"},
+	0x91: {name: "switch_off"},
+	0x92: {name: "playbgm_epi"},
+	0x93: {name: "set_mainwarp"},
+	0x94: {name: "set_obj_param"},
+	0x95: {name: "set_floor_handler"},
+	0x96: {name: "clr_floor_handler"},
+	0x97: {name: "col_plinaw"},
+	0x98: {name: "hud_hide"},
+	0x99: {name: "hud_show"},
+	0x9A: {name: "cine_enable"},
+	0x9B: {name: "cine_disable"},
+	0xA1: {name: "set_qt_failure"},
+	0xA2: {name: "set_qt_success"},
+	0xA3: {name: "clr_qt_failure"},
+	0xA4: {name: "clr_qt_success"},
+	0xA5: {name: "set_qt_cancel"},
+	0xA6: {name: "clr_qt_cancel"},
+	0xA8: {name: "pl_walk"},
+	0xB0: {name: "pl_add_meseta"},
+	0xB1: {name: "thread_stg"},
+	0xB2: {name: "del_obj_param"},
+	0xB3: {name: "item_create"},
+	0xB4: {name: "item_create2"},
+	0xB5: {name: "item_delete"},
+	0xB6: {name: "item_delete2"},
+	0xB7: {name: "item_check"},
+	0xB8: {name: "setevt"},
+	0xB9: {name: "get_difflvl", args: reg},
+	0xBA: {name: "set_qt_exit"},
+	0xBB: {name: "clr_qt_exit"},
+	0xC0: {name: "particle"},
+	0xC1: {name: "npc_text"},
+	0xC2: {name: "npc_chkwarp"},
+	0xC3: {name: "pl_pkoff"},
+	0xC4: {name: "map_designate"},
+	0xC5: {name: "masterkey_on"},
+	0xC6: {name: "masterkey_off"},
+	0xC7: {name: "window_time"},
+	0xC8: {name: "winend_time"},
+	0xC9: {name: "winset_time"},
+	0xCA: {name: "getmtime", args: reg},
+	0xCB: {name: "set_quest_board_handler"},
+	0xCC: {name: "clear_quest_board_handler"},
+	0xCD: {name: "particle_id"},
+	0xCE: {name: "npc_crptalk_id"},
+	0xCF: {name: "npc_lang_clean"},
+	0xD0: {name: "pl_pkon"},
+	0xD1: {name: "pl_chk_item2"},
+	0xD2: {name: "enable_mainmenu"},
+	0xD3: {name: "disable_mainmenu"},
+	0xD4: {name: "start_battlebgm"},
+	0xD5: {name: "end_battlebgm"},
+	0xD6: {name: "disp_msg_qb"},
+	0xD7: {name: "close_msg_qb"},
+	0xD8: {name: "set_eventflag"},
+	0xD9: {name: "sync_leti"},
+	0xDA: {name: "set_returnhunter"},
+	0xDB: {name: "set_returncity"},
+	0xDC: {name: "load_pvr"},
+	0xDD: {name: "load_midi"},
+	0xDF: {name: "npc_param"},
+	0xE0: {name: "pad_dragon"},
+	0xE1: {name: "clear_mainwarp"},
+	0xE2: {name: "pcam_param"},
+	0xE3: {name: "start_setevt"},
+	0xE4: {name: "warp_on"},
+	0xE5: {name: "warp_off"},
+	0xE6: {name: "get_slotnumber", args: reg},
+	0xE7: {name: "get_servernumber", args: reg},
+	0xE8: {name: "set_eventflag2"},
+	0xE9: {name: "res"},
+	0xEB: {name: "enable_bgmctrl"},
+	0xEC: {name: "sw_send"},
+	0xED: {name: "create_bgmctrl"},
+	0xEE: {name: "pl_add_meseta2"},
+	0xEF: {name: "sync_let"},
+
+	0xF801: {name: "set_chat_callback"},
+	0xF808: {name: "get_difficulty_level2", args: reg},
+	0xF809: {name: "get_number_of_players", args: reg},
+	0xF80A: {name: "get_coord_of_player"},
+	0xF80B: {name: "enable_map"},
+	0xF80C: {name: "disable_map"},
+	0xF80D: {name: "map_designate_ex"},
+	0xF80E: {name: "disable_weapon_drop"},
+	0xF80F: {name: "enable_weapon_drop"},
+	0xF810: {name: "ba_initial_floor"},
+	0xF811: {name: "set_ba_rules"},
+	0xF812: {name: "ba_set_tech"},
+	0xF813: {name: "ba_set_equip"},
+	0xF814: {name: "ba_set_mag"},
+	0xF815: {name: "ba_set_item"},
+	0xF816: {name: "ba_set_trapmenu"},
+	0xF818: {name: "ba_set_respawn"},
+	0xF819: {name: "ba_set_charity"},
+	0xF81A: {name: "ba_set_lvl"},
+	0xF81B: {name: "ba_set_time_limit"},
+	0xF81C: {name: "boss_is_dead", args: reg},
+	0xF8BC: {name: "set_episode", args: []argType{argInt}},
+	0xF8C0: {name: "file_dl_req"},
+	0xF8C1: {name: "get_dl_status", args: reg},
+	0xF8EE: {name: "call_image_data"},
+	0xF92B: {name: "get_paletteX_activated", args: reg},
+}
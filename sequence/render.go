@@ -0,0 +1,125 @@
+package sequence
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dcrodman/bb_reverse_proxy/proxy"
+)
+
+const (
+	clientLane = "Client"
+	proxyLane  = "Proxy"
+)
+
+// Builds the text of a diagram in either format.
+type diagram struct {
+	format Format
+	buf    strings.Builder
+	indent int
+	// Lane of the last server, which notes about sessions span to.
+	lastLane string
+}
+
+func (d *diagram) line(format string, args ...interface{}) {
+	d.buf.WriteString(strings.Repeat("    ", d.indent))
+	fmt.Fprintf(&d.buf, format, args...)
+	d.buf.WriteString("\n")
+}
+
+func (d *diagram) begin(servers []string) {
+	if d.format == Mermaid {
+		d.line("sequenceDiagram")
+		d.indent++
+	} else {
+		d.line("@startuml")
+	}
+	d.line("participant %s", clientLane)
+	d.line("participant %s", proxyLane)
+	for _, server := range servers {
+		d.line("participant %s", laneName(server))
+	}
+	if len(servers) > 0 {
+		d.lastLane = laneName(servers[len(servers)-1])
+	} else {
+		d.lastLane = proxyLane
+	}
+}
+
+func (d *diagram) end() {
+	if d.format == PlantUML {
+		d.line("@enduml")
+	}
+}
+
+func (d *diagram) step(s step) {
+	if s.session != nil {
+		text := fmt.Sprintf("%s session %d from %s at %s", s.session.Server, s.session.ID,
+			s.session.Client, s.session.Start.Format("15:04:05.000"))
+		if d.format == Mermaid {
+			d.line("Note over %s,%s: %s", clientLane, d.lastLane, text)
+		} else {
+			d.line("note over %s, %s : %s", clientLane, d.lastLane, text)
+		}
+		return
+	}
+
+	if len(s.messages) == 1 {
+		suffix := ""
+		if s.repeat > 1 {
+			suffix = fmt.Sprintf(" x%d", s.repeat)
+		}
+		d.message(s.messages[0], suffix)
+		return
+	}
+	d.line("loop %d times", s.repeat)
+	d.indent++
+	for _, msg := range s.messages {
+		d.message(msg, "")
+	}
+	d.indent--
+	d.line("end")
+}
+
+// Draws a packet as it passes through the proxy. Packets from the server are
+// drawn with dashed arrows like replies.
+func (d *diagram) message(msg message, suffix string) {
+	server := laneName(msg.server)
+	label := packetLabel(msg) + suffix
+	arrow, replyArrow := "->>", "-->>"
+	if d.format == PlantUML {
+		arrow, replyArrow = "->", "-->"
+	}
+	separator := ": "
+	if d.format == PlantUML {
+		separator = " : "
+	}
+	if msg.fromName == "Client" {
+		d.line("%s%s%s%s%s", clientLane, arrow, proxyLane, separator, label)
+		d.line("%s%s%s%s%s", proxyLane, arrow, server, separator, label)
+	} else {
+		d.line("%s%s%s%s%s", server, replyArrow, proxyLane, separator, label)
+		d.line("%s%s%s%s%s", proxyLane, replyArrow, clientLane, separator, label)
+	}
+}
+
+func packetLabel(msg message) string {
+	if name := proxy.PacketName(msg.server, msg.command); name != "" {
+		return name
+	}
+	return fmt.Sprintf("%04x", msg.command)
+}
+
+// Makes a server name safe to use as a participant in either syntax.
+func laneName(server string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, server)
+	if name == clientLane || name == proxyLane || name == "" {
+		name = "Server_" + name
+	}
+	return name
+}
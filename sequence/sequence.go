@@ -0,0 +1,244 @@
+// Package sequence renders the packets exchanged over PSO sessions as Mermaid
+// or PlantUML sequence diagrams, with lanes for the client, the proxy and each
+// server the client connects to.
+package sequence
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dcrodman/bb_reverse_proxy/proxy"
+)
+
+// Format is a sequence diagram syntax.
+type Format int
+
+const (
+	Mermaid Format = iota
+	PlantUML
+)
+
+// ParseFormat returns the format named "mermaid" or "plantuml".
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "mermaid":
+		return Mermaid, nil
+	case "plantuml":
+		return PlantUML, nil
+	}
+	return Mermaid, fmt.Errorf("unknown diagram format %q", name)
+}
+
+// Longest run of packets that's recognized as repeating, such as a request and
+// its response sent back and forth for every chunk of a file.
+const maxRepeatLength = 3
+
+const (
+	loginSecurityType = 0xE6
+	// Offset of the account's guild card number in the server's 0xE6 packet,
+	// which is sent on every connection once the client has logged in.
+	loginGuildcardOffset = 0x10
+)
+
+// Session describes one of the connections seen by a Recorder.
+type Session struct {
+	ID      uint64
+	Client  string
+	Server  string
+	Start   time.Time
+	Packets int
+	// Guild card number of the account that logged in, or 0 if not seen.
+	Guildcard uint32
+}
+
+// One packet on a session, as shown on the diagram.
+type message struct {
+	sessionID uint64
+	server    string
+	fromName  string
+	command   uint16
+}
+
+// Recorder is a Sink that keeps track of the packets exchanged on each session
+// so that they can be drawn once they've all been seen.
+type Recorder struct {
+	sessions map[uint64]*Session
+	messages []message
+}
+
+// NewRecorder returns an empty Recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{sessions: make(map[uint64]*Session)}
+}
+
+// WritePacket records the packet's command and direction.
+func (r *Recorder) WritePacket(packet *proxy.PacketMsg) {
+	// Responses from shadow servers never reach the client.
+	if packet.Err != nil || packet.FromName == proxy.ShadowName {
+		return
+	}
+	session := r.sessions[packet.SessionID]
+	if session == nil {
+		session = &Session{
+			ID:     packet.SessionID,
+			Client: packet.ClientAddr,
+			Server: packet.Server,
+			Start:  packet.Timestamp,
+		}
+		r.sessions[packet.SessionID] = session
+	}
+	session.Packets++
+	if packet.Command == loginSecurityType && packet.FromName == "Server" && session.Guildcard == 0 &&
+		len(packet.DecryptedData) >= loginGuildcardOffset+4 {
+		session.Guildcard = binary.LittleEndian.Uint32(packet.DecryptedData[loginGuildcardOffset:])
+	}
+	r.messages = append(r.messages, message{
+		sessionID: packet.SessionID,
+		server:    packet.Server,
+		fromName:  packet.FromName,
+		command:   packet.Command,
+	})
+}
+
+// Sessions returns the sessions recorded so far in the order they started.
+func (r *Recorder) Sessions() []Session {
+	var sessions []Session
+	for _, session := range r.sessions {
+		sessions = append(sessions, *session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].Start.Equal(sessions[j].Start) {
+			return sessions[i].Start.Before(sessions[j].Start)
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions
+}
+
+// Correlated returns the IDs of the sessions of the same player as the given
+// one, which covers each hop of their LOGIN, CHARACTER, SHIP and BLOCK
+// connections, in the order they started. Since several players can share a
+// client address, such as behind a NAT or when testing locally, sessions are
+// matched on the guild card number of the account that logged in. Only if the
+// given session has none, such as when the login failed, are all of the
+// sessions from its client address returned instead.
+func (r *Recorder) Correlated(sessionID uint64) []uint64 {
+	session := r.sessions[sessionID]
+	if session == nil {
+		return nil
+	}
+	var ids []uint64
+	for _, s := range r.Sessions() {
+		if clientHost(s.Client) != clientHost(session.Client) {
+			continue
+		}
+		if session.Guildcard == 0 || s.Guildcard == session.Guildcard {
+			ids = append(ids, s.ID)
+		}
+	}
+	return ids
+}
+
+func clientHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// An entry on the diagram: a message, a repeated run of them or the start of a
+// session.
+type step struct {
+	messages []message
+	repeat   int
+	// Set instead of messages for the start of a session.
+	session *Session
+}
+
+// Write draws the packets of the given sessions as one diagram, with a note at
+// the start of each session. Consecutive repeats of the same packet are drawn
+// once with a count, and repeated runs of a few packets as a loop.
+func (r *Recorder) Write(w io.Writer, format Format, sessionIDs []uint64) error {
+	included := make(map[uint64]bool)
+	for _, id := range sessionIDs {
+		if r.sessions[id] == nil {
+			return fmt.Errorf("no session %d", id)
+		}
+		included[id] = true
+	}
+
+	var servers []string
+	var steps []step
+	var run []message
+	started := make(map[uint64]bool)
+	for _, msg := range r.messages {
+		if !included[msg.sessionID] {
+			continue
+		}
+		if !started[msg.sessionID] {
+			started[msg.sessionID] = true
+			steps = append(steps, collapse(run)...)
+			run = nil
+			steps = append(steps, step{session: r.sessions[msg.sessionID]})
+			if !containsString(servers, msg.server) {
+				servers = append(servers, msg.server)
+			}
+		}
+		run = append(run, msg)
+	}
+	steps = append(steps, collapse(run)...)
+
+	d := &diagram{format: format}
+	d.begin(servers)
+	for _, s := range steps {
+		d.step(s)
+	}
+	d.end()
+	_, err := io.WriteString(w, d.buf.String())
+	return err
+}
+
+// Groups repeated runs of messages into steps, preferring whichever repeating
+// run covers the most messages.
+func collapse(messages []message) []step {
+	var steps []step
+	for i := 0; i < len(messages); {
+		bestLength, bestRepeat := 1, 1
+		for length := 1; length <= maxRepeatLength; length++ {
+			repeat := 1
+			for i+(repeat+1)*length <= len(messages) &&
+				sameMessages(messages[i:i+length], messages[i+repeat*length:i+(repeat+1)*length]) {
+				repeat++
+			}
+			if repeat > 1 && repeat*length > bestRepeat*bestLength {
+				bestLength, bestRepeat = length, repeat
+			}
+		}
+		steps = append(steps, step{messages: messages[i : i+bestLength], repeat: bestRepeat})
+		i += bestLength * bestRepeat
+	}
+	return steps
+}
+
+func sameMessages(a, b []message) bool {
+	for i := range a {
+		if a[i].server != b[i].server || a[i].fromName != b[i].fromName || a[i].command != b[i].command {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}